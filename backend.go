@@ -0,0 +1,56 @@
+package dlock
+
+import (
+	"fmt"
+	"sync"
+)
+
+// BackendFactory create Locker of a lock type from options
+type BackendFactory func(opts Options) (Locker, error)
+
+// backends registered lock types
+var backends = struct {
+	mux       sync.RWMutex
+	factories map[string]BackendFactory
+}{factories: map[string]BackendFactory{}}
+
+func init() {
+	RegisterBackend(MysqlLockType, func(opts Options) (Locker, error) { return NewMLock(opts) })
+	RegisterBackend(RedisLockType, func(opts Options) (Locker, error) { return NewRLock(opts) })
+	RegisterBackend(EtcdLockType, func(opts Options) (Locker, error) { return NewELock(opts) })
+	RegisterBackend(RedlockType, func(opts Options) (Locker, error) { return NewRedlock(opts) })
+	RegisterBackend(MemoryLockType, func(opts Options) (Locker, error) { return NewMemLock(opts) })
+}
+
+// RegisterBackend register lock type name, NewLocker and NewDLock create Locker of Options.Type by factory
+// like database/sql.Register, panic if name is empty, factory is nil or name is registered twice
+func RegisterBackend(name string, factory BackendFactory) {
+	if len(name) == 0 {
+		panic("dlock: register backend with empty name")
+	}
+	if factory == nil {
+		panic("dlock: register nil backend factory of " + name)
+	}
+
+	backends.mux.Lock()
+	defer backends.mux.Unlock()
+	if _, ok := backends.factories[name]; ok {
+		panic("dlock: register backend twice of " + name)
+	}
+	backends.factories[name] = factory
+}
+
+// backend factory of lock type, empty type is redis
+func backend(name string) (BackendFactory, error) {
+	if len(name) == 0 {
+		name = RedisLockType
+	}
+
+	backends.mux.RLock()
+	defer backends.mux.RUnlock()
+	factory, ok := backends.factories[name]
+	if !ok {
+		return nil, fmt.Errorf("lock type %q: %w", name, NotSupportedTypeLockErr)
+	}
+	return factory, nil
+}
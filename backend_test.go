@@ -0,0 +1,57 @@
+package dlock
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestRegisterBackend(t *testing.T) {
+	mr := miniredis.RunT(t)
+	const name = "test-backend"
+
+	var got Options
+	RegisterBackend(name, func(opts Options) (Locker, error) {
+		got = opts
+		return newMiniRLock(t, mr), nil
+	})
+	t.Cleanup(func() { unregisterBackend(name) })
+
+	l, err := NewDLock(func(opts *Options) {
+		opts.Type = name
+		opts.Cluster = []string{mr.Addr()}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Type != name || len(got.Cluster) != 1 {
+		t.Fatalf("factory options: %+v", got)
+	}
+	if success, err := l.Acquire(0, key, value, host); err != nil || !success {
+		t.Fatalf("acquire, success: %t, err: %v", success, err)
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("register twice not panic")
+			}
+		}()
+		RegisterBackend(name, func(opts Options) (Locker, error) { return nil, nil })
+	}()
+}
+
+// unregisterBackend remove lock type name registered by a test
+func unregisterBackend(name string) {
+	backends.mux.Lock()
+	defer backends.mux.Unlock()
+	delete(backends.factories, name)
+}
+
+func TestNewLocker_Unknown(t *testing.T) {
+	_, err := NewLocker(func(opts *Options) { opts.Type = "zk" })
+	if !errors.Is(err, NotSupportedTypeLockErr) {
+		t.Fatalf("unknown type, err: %v", err)
+	}
+}
@@ -0,0 +1,98 @@
+package dlock
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+)
+
+// Clock source of current time for expiry computation, injected by WithClock
+// timers of retry and renewal always run on the system clock
+type Clock interface {
+	Now() time.Time
+}
+
+// systemClock local clock, the default clock
+type systemClock struct{}
+
+// Now time.Now
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+const (
+	// serverTimeSql mysql server time in microseconds
+	serverTimeSql = "select cast(unix_timestamp(now(6)) * 1000000 as signed)"
+	// dbClockSyncInterval interval to measure the offset to mysql server clock again
+	dbClockSyncInterval = time.Minute
+)
+
+// dbClock mysql server clock, the local clock adjusted by its offset to UNIX_TIMESTAMP() of server
+// all holders of a database agree on expiry no matter how their local clocks are skewed
+type dbClock struct {
+	db  *sql.DB
+	log Logger
+
+	mux     *sync.Mutex
+	offset  time.Duration
+	synced  time.Time
+	syncing bool
+
+	// done after Close, no more sync
+	done   context.Context
+	cancel context.CancelFunc
+}
+
+// newDBClock create clock of mysql server, measure the offset at once
+func newDBClock(ctx context.Context, db *sql.DB, logger Logger) (*dbClock, error) {
+	c := &dbClock{db: db, log: logger, mux: &sync.Mutex{}}
+	c.done, c.cancel = context.WithCancel(context.Background())
+	if err := c.sync(ctx); err != nil {
+		c.cancel()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Close stop syncing the offset, the last offset is still used by Now
+func (c *dbClock) Close() {
+	c.cancel()
+}
+
+// Now local time adjusted by the offset, measure the offset again in background if stale
+func (c *dbClock) Now() time.Time {
+	now := time.Now()
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if !c.syncing && c.done.Err() == nil && now.Sub(c.synced) >= dbClockSyncInterval {
+		c.syncing = true
+		go func() {
+			ctx, cancel := context.WithTimeout(c.done, 5*time.Second)
+			defer cancel()
+			if err := c.sync(ctx); err != nil && c.done.Err() == nil {
+				c.log.Log(LevelWarn, "sync mysql server clock fail", "err", err)
+			}
+		}()
+	}
+	return now.Add(c.offset)
+}
+
+// sync measure the offset to server clock, half of the round trip is taken as the query delay
+func (c *dbClock) sync(ctx context.Context) error {
+	start := time.Now()
+	var micros int64
+	err := c.db.QueryRowContext(ctx, serverTimeSql).Scan(&micros)
+	end := time.Now()
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.syncing = false
+	if err != nil {
+		return err
+	}
+	c.offset = time.UnixMicro(micros).Sub(start.Add(end.Sub(start) / 2))
+	c.synced = end
+	return nil
+}
@@ -0,0 +1,92 @@
+package dlock
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// fakeClock clock moved by Add only
+type fakeClock struct {
+	mux *sync.Mutex
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{mux: &sync.Mutex{}, now: time.Unix(1700000000, 0)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.now
+}
+
+// Add move the clock forward
+func (c *fakeClock) Add(d time.Duration) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestDBClock(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// server clock is an hour ahead
+	server := time.Now().Add(time.Hour)
+	mock.ExpectQuery(serverTimeSql).WillReturnRows(sqlmock.NewRows([]string{"now"}).AddRow(server.UnixMicro()))
+	clock, err := newDBClock(context.Background(), db, nopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := clock.Now().Sub(time.Now().Add(time.Hour)); diff < -time.Second || diff > time.Second {
+		t.Fatalf("server clock offset error: %s", diff)
+	}
+
+	// no sync after close even if stale
+	clock.Close()
+	clock.synced = time.Time{}
+	clock.Now()
+	if clock.syncing {
+		t.Fatal("sync after close")
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMLock_DBClock(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	server := time.Now().Add(time.Hour)
+	expectTable(mock)
+	mock.ExpectQuery(serverTimeSql).WillReturnRows(sqlmock.NewRows([]string{"now"}).AddRow(server.UnixMicro()))
+	l, err := NewDLock(WithSQLDB(db), WithDBClock(), WithClock(newFakeClock()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// expire_at and expiry check by unix_timestamp() of server, no client time passed
+	mock.ExpectExec(acquireSql).WithArgs(acquireArgs(key, value, host, int64(60), nil)...).WillReturnResult(sqlmock.NewResult(1, 1))
+	if success, err := l.Acquire(time.Minute, key, value, host); err != nil || !success {
+		t.Fatalf("acquire fail, success: %t, err: %v", success, err)
+	}
+	mock.ExpectExec(releaseSql).WithArgs(sqlmock.AnyArg(), key, value, nil).WillReturnResult(sqlmock.NewResult(0, 1))
+	if err := l.UnLock(key); err != nil {
+		t.Fatalf("unlock fail, err: %v", err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,21 +1,27 @@
 package dlock
 
 import (
+	"context"
+	"crypto/sha1"
 	"database/sql"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"sync"
+	"strings"
 	"time"
 
 	"github.com/go-sql-driver/mysql"
-	_ "github.com/go-sql-driver/mysql"
 )
 
-var r *Repo
-var once sync.Once
-
 // Repo mysql repo
 type Repo struct {
-	db *sql.DB
+	db    *sql.DB
+	log   Logger
+	clock Clock
+	// expiry decided by unix_timestamp() of mysql server instead of clock, see WithDBClock
+	serverClock bool
+	// db opened by repo, closed by Close
+	ownDB bool
 }
 
 // LockTable table of lock
@@ -24,38 +30,112 @@ type LockTable struct {
 	Name         string
 	LockResource string
 	Host         string
-	// unix nano time; since 1970-01-01 00:00:00
+	// unix time in seconds; since 1970-01-01 00:00:00
 	ExpiredTime int64
-	CreateAt    time.Time
-	DeleteAt    *time.Time
+	// expiry from now when the row is written, expire_at is computed by the repo
+	Expiration time.Duration
+	CreateAt   time.Time
+	DeleteAt   *time.Time
+	// times the row is taken over after released or expired
+	Fencing int64
+}
+
+// token fencing token of the row, increase on every takeover
+func (t *LockTable) token() int64 {
+	return t.ID + t.Fencing
 }
 
 const (
-	insertSql = "INSERT INTO dlock (name, lock_resource, host , expire_at,created_at,deleted_at) VALUES (?, ?, ?, ?, ?,null)"
-	querySql  = "select id, name, lock_resource,host ,expire_at,timestamp(created_at),deleted_at from dlock where name = ? and expire_at > ? for update "
-	updateSql = "update dlock set deleted_at = ?  where id  =?"
-	createSql = `
+	checkTableSql = "select 1 from dlock limit 1"
+	querySql      = "select id, name, lock_resource,host ,expire_at,timestamp(created_at),deleted_at,fencing from dlock where name = ? and expire_at > " + nowExpr + " and deleted_at is null"
+	// release only when lock_resource matches the holder
+	releaseSql = "update dlock set deleted_at = ? where name = ? and lock_resource = ? and deleted_at is null and expire_at > " + nowExpr
+	// renew only when lock_resource matches the holder
+	renewSql = "update dlock set expire_at = ? + " + nowExpr + " where name = ? and lock_resource = ? and deleted_at is null and expire_at > " + nowExpr
+	// reentrant lock: release once, the row is deleted when hold_count reach 0
+	decreaseSql      = "update dlock set hold_count = hold_count - 1 where name = ? and lock_resource = ? and deleted_at is null and expire_at > " + nowExpr
+	releaseEmptySql  = "update dlock set deleted_at = ? where name = ? and lock_resource = ? and deleted_at is null and hold_count <= 0"
+	checkHoldSql     = "select hold_count from dlock limit 1"
+	addHoldColumnSql = "alter table dlock add column hold_count int(11) not null default 1 comment '重入次数'"
+	// unique name: one row per name, taken over by acquireSql
+	checkFencingSql     = "select fencing from dlock limit 1"
+	addFencingColumnSql = "alter table dlock add column fencing bigint not null default 0 comment '接管次数'"
+	// id is consumed by every acquireSql, so id and fencing are bigint
+	checkBigintSql    = "select count(*) from information_schema.columns where table_schema = database() and table_name = 'dlock' and column_name in ('id', 'fencing') and data_type <> 'bigint'"
+	widenSql          = "alter table dlock modify id bigint unsigned auto_increment comment '主键', modify fencing bigint not null default 0 comment '接管次数'"
+	checkNameIndexSql = "select count(*) from information_schema.statistics where table_schema = database() and table_name = 'dlock' and index_name = 'uk_name'"
+	dedupNameSql      = "delete d from dlock d join dlock n on d.name = n.name and d.id < n.id"
+	addNameIndexSql   = "alter table dlock add unique index uk_name (name)"
+	// remove released or expired row, the name is inserted again as a new row
+	deleteDeadSql = "delete from dlock where name = ? and " + takeoverCond
+	// read/write lock
+	countPrefixSql = "select count(*) from dlock where name like ? escape '!' and deleted_at is null and expire_at > " + nowExpr
+	countNameSql   = "select count(*) from dlock where name = ?"
+	waitSql        = "update dlock set expire_at = ? + " + nowExpr + ", deleted_at = null where name = ?"
+	cancelWaitSql  = "update dlock set deleted_at = ? where name = ? and deleted_at is null"
+	getLockSql     = "select get_lock(?, ?)"
+	releaseLockSql = "select release_lock(?)"
+	aliveSql       = "select count(*) from dlock where name = ? and deleted_at is null and expire_at > " + nowExpr
+	queueHeadSql   = "select name from dlock where name like ? escape '!' and deleted_at is null and expire_at > " + nowExpr + " order by id limit 1"
+	createSql      = `
 		create table dlock
 		(
-			id int(11) unsigned auto_increment comment '主键'
+			id bigint unsigned auto_increment comment '主键'
 				primary key,
 			created_at timestamp null comment '记录创建时间',
 			deleted_at timestamp null comment '记录删除时间',
 			name varchar(64) null comment '资源名称， lock key',
 			lock_resource varchar(64) null comment '资源信息，lock value, uuid/code/......',
 			host varchar(64) null comment '运行的主机,hostname or hostIp',
-			expire_at int(11) null comment '过期时间'
+			expire_at int(11) null comment '过期时间',
+			hold_count int(11) not null default 1 comment '重入次数',
+			fencing bigint not null default 0 comment '接管次数',
+			unique key uk_name (name)
 		) comment '分布式锁' ENGINE=InnoDB AUTO_INCREMENT=3 DEFAULT CHARSET=utf8mb4;`
 )
 
-// initRepo init database connection
-// dsn  mysql dataSourceName
-func initRepo(user, password, database, ip string, port int64) (*Repo, error) {
-	if r != nil {
-		return r, nil
-	}
+// nowExpr current unix time in seconds, the argument is now of repo clock, or nil to use mysql server clock
+const nowExpr = "coalesce(?, unix_timestamp())"
+
+// takeoverCond the existing row of the name is released or expired
+const takeoverCond = "(deleted_at is not null or expire_at <= " + nowExpr + ")"
+
+// reentryCond the existing row of the name is alive and held by the same lock_resource
+const reentryCond = "(not " + takeoverCond + " and lock_resource = values(lock_resource))"
+
+// acquireSql insert lock row, or take over the existing one of the name if takeoverCond holds
+// last_insert_id is id + fencing when inserted or taken over, and 0 when the row is alive;
+// every statement consumes an auto increment id even if no row is inserted, so id is bigint
+var acquireSql = upsertSql("false")
+
+// reentrantAcquireSql acquireSql, and increase hold_count of the row held by the same lock_resource,
+// last_insert_id is the unchanged id + fencing then
+var reentrantAcquireSql = upsertSql(reentryCond)
+
+// upsertSql insert lock row, or update the existing row of the name on duplicate key
+// reentry: condition to acquire the alive row again
+// columns are assigned in order, conditions read lock_resource, expire_at and deleted_at, so they are the last
+func upsertSql(reentry string) string {
+	return "INSERT INTO dlock (name, lock_resource, host, expire_at, created_at, deleted_at, hold_count) VALUES (?, ?, ?, ? + " + nowExpr + ", ?, null, 1) " +
+		"ON DUPLICATE KEY UPDATE " +
+		"fencing = if(" + takeoverCond + ", last_insert_id(id + fencing + 1) - id, if(" + reentry + ", last_insert_id(id + fencing) - id, fencing + last_insert_id(0))), " +
+		"hold_count = if(" + takeoverCond + ", 1, if(" + reentry + ", hold_count + 1, hold_count)), " +
+		"host = if(" + takeoverCond + ", values(host), host), " +
+		"created_at = if(" + takeoverCond + ", values(created_at), created_at), " +
+		"lock_resource = if(" + takeoverCond + ", values(lock_resource), lock_resource), " +
+		"expire_at = if(" + takeoverCond + " or " + reentry + ", values(expire_at), expire_at), " +
+		"deleted_at = null"
+}
 
-	Info("start to init repo.")
+// upsertValues number of arguments of values in upsertSql, the others are now
+const upsertValues = 6
+
+// initRepo init database connection, every repo owns its connection pool
+// dsn  mysql dataSourceName
+// logger: log of repo, nopLogger{} to discard
+// clock: current time of expiry computation
+func initRepo(user, password, database, ip string, port int64, logger Logger, clock Clock) (*Repo, error) {
+	logger.Log(LevelDebug, "init mysql repo", "host", ip, "port", port, "database", database)
 
 	var err error
 	// init repo
@@ -71,20 +151,40 @@ func initRepo(user, password, database, ip string, port int64) (*Repo, error) {
 	db.SetMaxIdleConns(25)
 	db.SetMaxOpenConns(25)
 
+	r, err := newRepo(db, logger, clock)
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	r.ownDB = true
+	return r, nil
+}
+
+// newRepo create repo on caller-supplied db, the db is not closed by Close
+func newRepo(db *sql.DB, logger Logger, clock Clock) (*Repo, error) {
 	// ping test
 	if err := db.Ping(); err != nil {
+		return nil, unavailableErr(err)
+	}
+	logger.Log(LevelDebug, "ping database successful")
+
+	//init table
+	r := &Repo{db: db, log: logger, clock: clock}
+	if err := r.initTable(); err != nil {
 		return nil, err
 	}
-	Info("ping database successful")
+	return r, nil
+}
 
-	once.Do(func() {
-		//init table
-		r = &Repo{db: db}
-		if err = r.initTable(); err != nil {
-			return
-		}
-	})
-	return r, err
+// Close stop syncing server clock, close database connection pool if owned by repo
+func (r *Repo) Close() error {
+	if c, ok := r.clock.(*dbClock); ok {
+		c.Close()
+	}
+	if !r.ownDB {
+		return nil
+	}
+	return r.db.Close()
 }
 
 // assemblyDSN
@@ -103,39 +203,90 @@ func assemblyDSN(dbUser, dbPassword, dbHost, dbName string, dbPort int64) string
 // initTable init table
 func (r *Repo) initTable() error {
 	// check table is exist
-	if exist, _ := r.checkTableIsNotExist(); exist {
+	if exist, err := r.checkTableIsNotExist(); err != nil {
+		return err
+	} else if exist {
 		if err := r.createTable(); err != nil {
 			return err
 		}
 	}
 
-	return nil
+	// table created by older version has no hold_count, fencing column or unique name, and int id
+	if err := r.addColumn("hold_count", checkHoldSql, addHoldColumnSql); err != nil {
+		return err
+	}
+	if err := r.addColumn("fencing", checkFencingSql, addFencingColumnSql); err != nil {
+		return err
+	}
+	if err := r.widenColumns(); err != nil {
+		return err
+	}
+	return r.addNameIndex()
 }
 
-// createTable check table is exist
-func (r *Repo) createTable() error {
-	tx, err := r.db.Begin()
-	if err != nil {
+// widenColumns modify id and fencing to bigint if not yet
+func (r *Repo) widenColumns() error {
+	var count int64
+	if err := r.db.QueryRow(checkBigintSql).Scan(&count); err != nil || count == 0 {
 		return err
 	}
 
-	_, err = tx.Exec(createSql)
+	r.log.Log(LevelInfo, "modify id and fencing of dlock table to bigint")
+	_, err := r.db.Exec(widenSql)
+	return err
+}
 
-	if err != nil {
-		_ = tx.Rollback()
+// addColumn add column by alter if check fails with unknown column
+func (r *Repo) addColumn(column, check, alter string) error {
+	rows, err := r.db.Query(check)
+	if err == nil {
+		return rows.Close()
+	}
+
+	// 1054: unknown column
+	if mysqlErr, ok := err.(*mysql.MySQLError); ok && mysqlErr != nil && mysqlErr.Number == 1054 {
+		r.log.Log(LevelInfo, "add column to dlock table", "column", column)
+		_, err = r.db.Exec(alter)
+	}
+	return err
+}
+
+// addNameIndex add unique index of name if not exists
+// older version inserted a row per acquisition, only the latest row of a name is kept,
+// its id is the last fencing token, so tokens keep increasing after takeover
+func (r *Repo) addNameIndex() error {
+	var count int64
+	if err := r.db.QueryRow(checkNameIndexSql).Scan(&count); err != nil || count > 0 {
+		return err
+	}
+
+	r.log.Log(LevelInfo, "add unique index of name to dlock table")
+	if _, err := r.db.Exec(dedupNameSql); err != nil {
 		return err
 	}
-	defer tx.Commit()
-	return nil
+	_, err := r.db.Exec(addNameIndexSql)
+	// 1061: duplicate key name, added by another repo meanwhile
+	if mysqlErr, ok := err.(*mysql.MySQLError); ok && mysqlErr != nil && mysqlErr.Number == 1061 {
+		return nil
+	}
+	return err
+}
+
+// createTable create dlock table, ddl is committed implicitly by mysql
+func (r *Repo) createTable() error {
+	r.log.Log(LevelInfo, "create dlock table")
+	_, err := r.db.Exec(createSql)
+	return err
 }
 
 // checkTableIsNotExist check table is exist
 func (r *Repo) checkTableIsNotExist() (bool, error) {
-	_, err := r.db.Query("select * from dlock")
+	rows, err := r.db.Query(checkTableSql)
 	if err == nil {
-		return false, nil
+		return false, rows.Close()
 	}
 
+	// 1146: table doesn't exist
 	if mysqlErr, ok := err.(*mysql.MySQLError); ok && mysqlErr != nil && mysqlErr.Number == 1146 {
 		return true, nil
 	}
@@ -143,120 +294,359 @@ func (r *Repo) checkTableIsNotExist() (bool, error) {
 	return false, err
 }
 
-// QueryLockRes
-func (r *Repo) queryLockRes(cond *LockTable) (table *LockTable, err error) {
-	tx, err := r.db.Begin()
-	defer tx.Commit()
-	if err != nil {
-		return
-	}
+// txBeginner *sql.DB or *sql.Conn
+type txBeginner interface {
+	BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error)
+}
 
-	rows, err := tx.Query(querySql, cond.Name, time.Now())
+// withTx run fn in a transaction of repo db, see runTx
+func (r *Repo) withTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	return runTx(ctx, r.db, fn)
+}
+
+// runTx run fn in a transaction, commit if fn succeeds, otherwise roll back and return the error of fn
+// the transaction is rolled back if fn panics, and the panic goes on
+func runTx(ctx context.Context, db txBeginner, fn func(tx *sql.Tx) error) (err error) {
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
-		_ = tx.Rollback()
-		return
+		return err
 	}
 
-	table = &LockTable{}
-	for rows.Next() {
-		if err = rows.Scan(&table.ID, &table.Name, &table.LockResource, &table.Host, &table.ExpiredTime, &table.CreateAt, &table.DeleteAt); err != nil {
+	committed := false
+	defer func() {
+		if !committed {
 			_ = tx.Rollback()
-			_ = rows.Close()
-			return
 		}
-	}
+	}()
 
-	return
+	if err = fn(tx); err != nil {
+		return err
+	}
+	committed = true
+	return tx.Commit()
 }
 
-// insertLockRes
-func (r *Repo) insertLockRes(tab *LockTable) (affected int64, err error) {
-	tx, err := r.db.Begin()
-	defer tx.Commit()
-
+// exec run single statement, return rows affected
+func (r *Repo) exec(ctx context.Context, query string, args ...interface{}) (int64, error) {
+	result, err := r.db.ExecContext(ctx, query, args...)
 	if err != nil {
-		return
+		return 0, err
 	}
+	return result.RowsAffected()
+}
 
-	// check current_time timestamp after lock expire_time timestamp
-	rows, err := tx.Query(querySql, tab.Name, time.Now().Unix())
-	if err != nil {
-		_ = tx.Rollback()
-		return
+// now argument of nowExpr
+func (r *Repo) now() interface{} {
+	if r.serverClock {
+		return nil
 	}
+	return r.clock.Now().Unix()
+}
+
+// expireSeconds expiration in seconds rounded up, a row never expires before its holder expects
+func expireSeconds(expiration time.Duration) int64 {
+	return int64((expiration + time.Second - 1) / time.Second)
+}
 
+// queryer *sql.DB or *sql.Tx
+type queryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// queryLock alive lock row of name
+// return nil if not found
+func (r *Repo) queryLock(ctx context.Context, db queryer, name string) (*LockTable, error) {
 	table := &LockTable{}
-	for rows.Next() {
-		if err = rows.Scan(&table.ID, &table.Name, &table.LockResource, &table.Host, &table.ExpiredTime, &table.CreateAt, &table.DeleteAt); err != nil {
-			_ = tx.Rollback()
-			_ = rows.Close()
-			return
-		}
+	err := db.QueryRowContext(ctx, querySql, name, r.now()).
+		Scan(&table.ID, &table.Name, &table.LockResource, &table.Host, &table.ExpiredTime, &table.CreateAt, &table.DeleteAt, &table.Fencing)
+	if err == sql.ErrNoRows {
+		return nil, nil
 	}
+	if err != nil {
+		return nil, err
+	}
+	return table, nil
+}
 
-	if table.ID > 0 {
-		return 0, fmt.Errorf("%s is already exists", tab.Name)
+// execer *sql.DB or *sql.Tx
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// insertLock insert lock row of tab, or take over the row of the name if released or expired,
+// in one statement against the unique name
+// return fencing token of the row, 0 if the row is alive
+func (r *Repo) insertLock(ctx context.Context, db execer, tab *LockTable) (int64, error) {
+	return r.upsertLock(ctx, db, acquireSql, tab)
+}
+
+// upsertLock run query of upsertSql for tab, return last_insert_id
+func (r *Repo) upsertLock(ctx context.Context, db execer, query string, tab *LockTable) (int64, error) {
+	now := r.now()
+	args := []interface{}{tab.Name, tab.LockResource, tab.Host, expireSeconds(tab.Expiration), now, r.clock.Now()}
+	for i := upsertValues; i < strings.Count(query, "?"); i++ {
+		args = append(args, now)
 	}
 
-	result, err := tx.Exec(insertSql, tab.Name, tab.LockResource, tab.Host, tab.ExpiredTime, time.Now())
+	result, err := db.ExecContext(ctx, query, args...)
 	if err != nil {
-		_ = tx.Rollback()
-		return
+		return 0, err
 	}
-
+	// new row: auto increment id, taken over or acquired again: id + fencing, alive: 0
 	return result.LastInsertId()
 }
 
-// deleteLockRes
-func (r *Repo) deleteLockRes(id int64) (affected int64, err error) {
-	tx, err := r.db.Begin()
+// queryLockRes alive lock row of cond.Name, nil if not locked
+// plain read without transaction, the row is not locked
+func (r *Repo) queryLockRes(ctx context.Context, cond *LockTable) (*LockTable, error) {
+	return r.queryLock(ctx, r.db, cond.Name)
+}
+
+// insertLockRes insert lock row if no alive row of the name
+// return fencing token of the lock row, 0 if held
+func (r *Repo) insertLockRes(ctx context.Context, tab *LockTable) (token int64, err error) {
+	return r.insertLock(ctx, r.db, tab)
+}
+
+// reentrantLockRes insert lock, or increase hold_count if held by the same lock_resource, in one statement
+// return fencing token of the lock row, 0 if held by another lock_resource
+func (r *Repo) reentrantLockRes(ctx context.Context, tab *LockTable) (id int64, err error) {
+	return r.upsertLock(ctx, r.db, reentrantAcquireSql, tab)
+}
+
+// releaseReentrantLockKey decrease hold_count of key only if lock_resource matches,
+// release the lock when hold_count reach 0
+func (r *Repo) releaseReentrantLockKey(ctx context.Context, key, value string) (affected int64, err error) {
+	err = r.withTx(ctx, func(tx *sql.Tx) error {
+		result, err := tx.ExecContext(ctx, decreaseSql, key, value, r.now())
+		if err != nil {
+			return err
+		}
+		if affected, err = result.RowsAffected(); err != nil || affected == 0 {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, releaseEmptySql, r.clock.Now(), key, value)
+		return err
+	})
+	return
+}
+
+// deleteLockKey release lock of key only if lock_resource matches
+func (r *Repo) deleteLockKey(ctx context.Context, key, value string) (affected int64, err error) {
+	return r.exec(ctx, releaseSql, r.clock.Now(), key, value, r.now())
+}
+
+// renewLockKey extend expire_at of key only if lock_resource matches
+func (r *Repo) renewLockKey(ctx context.Context, key, value string, expiration time.Duration) (affected int64, err error) {
+	return r.exec(ctx, renewSql, expireSeconds(expiration), r.now(), key, value, r.now())
+}
+
+// guard run fn in a transaction, serialized by mysql named lock of key
+func (r *Repo) guard(ctx context.Context, key string, fn func(tx *sql.Tx) error) (err error) {
+	conn, err := r.db.Conn(ctx)
 	if err != nil {
 		return
 	}
+	defer conn.Close()
 
-	result, err := tx.Exec(updateSql, time.Now(), id)
-	if err != nil {
-		_ = tx.Rollback()
+	// wait named lock at most 10s
+	name := guardName(key)
+	var got sql.NullInt64
+	if err = conn.QueryRowContext(ctx, getLockSql, name, 10).Scan(&got); err != nil {
 		return
 	}
+	if !got.Valid || got.Int64 != 1 {
+		return fmt.Errorf("get mysql named lock %s timeout", name)
+	}
+	defer conn.ExecContext(context.Background(), releaseLockSql, name)
 
-	return result.RowsAffected()
+	return runTx(ctx, conn, fn)
 }
 
-// deleteLockRes
-func (r *Repo) deleteLockKey(key interface{}) (affected int64, err error) {
-	tx, err := r.db.Begin()
-	defer tx.Commit()
+// guardName mysql named lock is at most 64 characters
+func guardName(key string) string {
+	name := "dlock:" + key
+	if len(name) <= 64 {
+		return name
+	}
+	sum := sha1.Sum([]byte(key))
+	return "dlock:" + hex.EncodeToString(sum[:])
+}
 
-	if err != nil {
-		return
+// likeEscaper escape wildcards of like pattern with '!'
+var likeEscaper = strings.NewReplacer("!", "!!", "%", "!%", "_", "!_")
+
+// countPrefix count active rows whose name starts with prefix
+func (r *Repo) countPrefix(ctx context.Context, tx *sql.Tx, prefix string) (count int64, err error) {
+	escaped := likeEscaper.Replace(prefix)
+	err = tx.QueryRowContext(ctx, countPrefixSql, escaped+"%", r.now()).Scan(&count)
+	return
+}
+
+// rLockRes insert reader row of key if no writer holds or waits
+// return fencing token of the row, 0 if not acquired
+func (r *Repo) rLockRes(ctx context.Context, key string, tab *LockTable) (id int64, err error) {
+	err = r.guard(ctx, key, func(tx *sql.Tx) error {
+		for _, kind := range []string{"w", "x"} {
+			count, err := r.countPrefix(ctx, tx, holderRowName(key, kind, ""))
+			if err != nil || count > 0 {
+				return err
+			}
+		}
+
+		id, err = r.insertLock(ctx, tx, tab)
+		return err
+	})
+	return
+}
+
+// fairLockRes insert lock row of key if waiting row is the head of the queue
+// waiting: queue row of the caller, inserted if not alive, renewed otherwise;
+// nil to acquire only if the queue is empty
+// return fencing token of the lock row, 0 if not acquired
+func (r *Repo) fairLockRes(ctx context.Context, key string, tab, waiting *LockTable) (id int64, err error) {
+	err = r.guard(ctx, key, func(tx *sql.Tx) error {
+		if waiting != nil {
+			if err := r.enqueue(ctx, tx, waiting); err != nil {
+				return err
+			}
+		}
+
+		// the first alive queue row is the head, expired waiters are skipped
+		var head string
+		escaped := likeEscaper.Replace(holderRowName(key, "q", ""))
+		err := tx.QueryRowContext(ctx, queueHeadSql, escaped+"%", r.now()).Scan(&head)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		if len(head) > 0 && (waiting == nil || head != waiting.Name) {
+			return nil
+		}
+
+		var held int64
+		if err := tx.QueryRowContext(ctx, aliveSql, key, r.now()).Scan(&held); err != nil || held > 0 {
+			return err
+		}
+
+		if waiting != nil {
+			if _, err := tx.ExecContext(ctx, cancelWaitSql, r.clock.Now(), waiting.Name); err != nil {
+				return err
+			}
+		}
+		id, err = r.insertLock(ctx, tx, tab)
+		return err
+	})
+	return
+}
+
+// enqueue insert queue row at the tail if not alive, otherwise renew its expire_at
+// an expired row is deleted, so the waiter is queued again at the tail with a new id
+func (r *Repo) enqueue(ctx context.Context, tx *sql.Tx, waiting *LockTable) error {
+	var alive int64
+	if err := tx.QueryRowContext(ctx, aliveSql, waiting.Name, r.now()).Scan(&alive); err != nil {
+		return err
+	}
+	if alive > 0 {
+		_, err := tx.ExecContext(ctx, renewSql, expireSeconds(waiting.Expiration), r.now(), waiting.Name, waiting.LockResource, r.now())
+		return err
 	}
 
-	// check current_time timestamp after lock expire_time timestamp
-	rows, err := tx.Query(querySql, key, time.Now().Unix())
-	if err != nil {
-		_ = tx.Rollback()
-		return
+	if _, err := tx.ExecContext(ctx, deleteDeadSql, waiting.Name, r.now()); err != nil {
+		return err
 	}
+	_, err := r.insertLock(ctx, tx, waiting)
+	return err
+}
 
-	table := &LockTable{}
-	for rows.Next() {
-		if err = rows.Scan(&table.ID, &table.LockResource, &table.Host, &table.ExpiredTime, &table.CreateAt, &table.DeleteAt); err != nil {
-			_ = tx.Rollback()
-			_ = rows.Close()
-			return
+// multiLockRes insert rows of all tabs in one transaction, rows are locked in order of name
+// return fencing tokens in order of tabs, nil if any name is held, and nothing is inserted then
+func (r *Repo) multiLockRes(ctx context.Context, tabs []*LockTable) (ids []int64, err error) {
+	idByName := make(map[string]int64, len(tabs))
+	err = r.withTx(ctx, func(tx *sql.Tx) error {
+		for _, tab := range sortedTables(tabs) {
+			token, err := r.insertLock(ctx, tx, tab)
+			if err != nil {
+				return err
+			}
+			if token == 0 {
+				// roll back rows inserted
+				return heldErr(tab.Name)
+			}
+			idByName[tab.Name] = token
 		}
+		return nil
+	})
+	if errors.Is(err, ErrLockHeld) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
 	}
 
-	if table.ID > 0 {
-		return 0, nil
+	for _, tab := range tabs {
+		ids = append(ids, idByName[tab.Name])
 	}
+	return ids, nil
+}
 
-	result, err := tx.Exec(updateSql, table.ID)
-	if err != nil {
-		_ = tx.Rollback()
-		return
+// semaphoreRes insert permit row if less than permits rows of key are alive
+// return fencing token of row inserted, 0 if all permits are held
+func (r *Repo) semaphoreRes(ctx context.Context, key string, permits int64, tab *LockTable) (id int64, err error) {
+	err = r.guard(ctx, key, func(tx *sql.Tx) error {
+		count, err := r.countPrefix(ctx, tx, holderRowName(key, "s", ""))
+		if err != nil || count >= permits {
+			return err
+		}
+
+		id, err = r.insertLock(ctx, tx, tab)
+		return err
+	})
+	return
+}
+
+// wLockRes insert writer row of key if no one holds, otherwise insert or extend the waiting row
+// return fencing token of the writer row, 0 if not acquired
+func (r *Repo) wLockRes(ctx context.Context, key string, tab, waiting *LockTable) (id int64, err error) {
+	err = r.guard(ctx, key, func(tx *sql.Tx) error {
+		var held int64
+		for _, kind := range []string{"w", "r"} {
+			count, err := r.countPrefix(ctx, tx, holderRowName(key, kind, ""))
+			if err != nil {
+				return err
+			}
+			held += count
+		}
+
+		if held > 0 {
+			return r.markWaiting(ctx, tx, waiting)
+		}
+
+		if _, err := tx.ExecContext(ctx, cancelWaitSql, r.clock.Now(), waiting.Name); err != nil {
+			return err
+		}
+		id, err = r.insertLock(ctx, tx, tab)
+		return err
+	})
+	return
+}
+
+// markWaiting insert waiting row, or extend it if exists
+func (r *Repo) markWaiting(ctx context.Context, tx *sql.Tx, waiting *LockTable) error {
+	var count int64
+	if err := tx.QueryRowContext(ctx, countNameSql, waiting.Name).Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		_, err := tx.ExecContext(ctx, waitSql, expireSeconds(waiting.Expiration), r.now(), waiting.Name)
+		return err
 	}
+	_, err := r.insertLock(ctx, tx, waiting)
+	return err
+}
 
-	return result.LastInsertId()
+// cancelWaitRes soft delete waiting row
+func (r *Repo) cancelWaitRes(ctx context.Context, name string) error {
+	_, err := r.db.ExecContext(ctx, cancelWaitSql, r.clock.Now(), name)
+	return err
 }
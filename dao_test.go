@@ -1,108 +1,369 @@
 package dlock
 
 import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
 	"fmt"
+	"os"
+	"strings"
 	"testing"
 	"time"
-)
 
-const (
-	user     = "root"
-	password = "Yunjikeji#123"
-	ip       = "10.0.2.8"
-	database = "cloudboot_3.0.0"
-	port     = 3306
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-sql-driver/mysql"
 )
 
-func Test_initRepo(t *testing.T) {
-	_, err := initRepo(user, password, database, ip, port)
+// newMockRepo create repo on sqlmock db with dlock table, expectations are checked on cleanup
+func newMockRepo(t *testing.T) (*Repo, sqlmock.Sqlmock) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
 
+	expectTable(mock)
+	r, err := newRepo(db, nopLogger{}, systemClock{})
 	if err != nil {
-		t.Error(err)
-		return
+		t.Fatal(err)
 	}
+
+	t.Cleanup(func() {
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+	return r, mock
 }
 
-func Test_createTable(t *testing.T) {
-	r, _ := initRepo(user, password, database, ip, port)
+// expectTable expect checks of newRepo on an up to date dlock table
+func expectTable(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery(checkTableSql).WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	mock.ExpectQuery(checkHoldSql).WillReturnRows(sqlmock.NewRows([]string{"hold_count"}))
+	mock.ExpectQuery(checkFencingSql).WillReturnRows(sqlmock.NewRows([]string{"fencing"}))
+	mock.ExpectQuery(checkBigintSql).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	mock.ExpectQuery(checkNameIndexSql).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+}
 
-	err := r.createTable()
-	if err != nil {
-		t.Error(err)
-		return
+// lockRows result of querySql
+func lockRows(tabs ...*LockTable) *sqlmock.Rows {
+	rows := sqlmock.NewRows([]string{"id", "name", "lock_resource", "host", "expire_at", "created_at", "deleted_at", "fencing"})
+	for _, tab := range tabs {
+		rows.AddRow(tab.ID, tab.Name, tab.LockResource, tab.Host, tab.ExpiredTime, tab.CreateAt, nil, tab.Fencing)
 	}
+	return rows
 }
 
-func Test_checkTableIsNotExist(t *testing.T) {
-	r, _ := initRepo(user, password, database, ip, port)
+// acquireArgs arguments of acquireSql
+// expiration: seconds of expiry, now: argument of nowExpr, created_at is not checked
+func acquireArgs(name, value, host string, expiration, now driver.Value) []driver.Value {
+	return upsertArgs(acquireSql, name, value, host, expiration, now)
+}
 
-	exists, err := r.checkTableIsNotExist()
-	if err != nil {
-		t.Error(err)
-		return
+// upsertArgs arguments of query built by upsertSql
+func upsertArgs(query, name, value, host string, expiration, now driver.Value) []driver.Value {
+	args := []driver.Value{name, value, host, expiration, now, sqlmock.AnyArg()}
+	for i := upsertValues; i < strings.Count(query, "?"); i++ {
+		args = append(args, now)
 	}
-	fmt.Println(exists)
+	return args
+}
+
+// expectGuard expect the named lock and transaction of guard around expect
+func expectGuard(mock sqlmock.Sqlmock, key string, expect func()) {
+	mock.ExpectQuery(getLockSql).WithArgs(guardName(key), 10).WillReturnRows(sqlmock.NewRows([]string{"got"}).AddRow(1))
+	mock.ExpectBegin()
+	expect()
+	mock.ExpectCommit()
+	mock.ExpectExec(releaseLockSql).WithArgs(guardName(key)).WillReturnResult(sqlmock.NewResult(0, 0))
+}
+
+// countRows result of count(*)
+func countRows(count int64) *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"count"}).AddRow(count)
+}
+
+// prefixArg like pattern of countPrefix for rows of kind
+func prefixArg(key, kind string) string {
+	return likeEscaper.Replace(holderRowName(key, kind, "")) + "%"
+}
+
+func Test_newRepo(t *testing.T) {
+	t.Run("create table", func(t *testing.T) {
+		db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		defer db.Close()
+
+		mock.ExpectQuery(checkTableSql).WillReturnError(&mysql.MySQLError{Number: 1146})
+		mock.ExpectExec(createSql).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery(checkHoldSql).WillReturnRows(sqlmock.NewRows([]string{"hold_count"}))
+		mock.ExpectQuery(checkFencingSql).WillReturnRows(sqlmock.NewRows([]string{"fencing"}))
+		mock.ExpectQuery(checkBigintSql).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+		mock.ExpectQuery(checkNameIndexSql).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+		if _, err := newRepo(db, nopLogger{}, systemClock{}); err != nil {
+			t.Fatal(err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("upgrade older table", func(t *testing.T) {
+		db, mock, _ := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		defer db.Close()
+
+		mock.ExpectQuery(checkTableSql).WillReturnRows(sqlmock.NewRows([]string{"id"}))
+		mock.ExpectQuery(checkHoldSql).WillReturnError(&mysql.MySQLError{Number: 1054})
+		mock.ExpectExec(addHoldColumnSql).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery(checkFencingSql).WillReturnError(&mysql.MySQLError{Number: 1054})
+		mock.ExpectExec(addFencingColumnSql).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery(checkBigintSql).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
+		mock.ExpectExec(widenSql).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery(checkNameIndexSql).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+		mock.ExpectExec(dedupNameSql).WillReturnResult(sqlmock.NewResult(0, 3))
+		mock.ExpectExec(addNameIndexSql).WillReturnResult(sqlmock.NewResult(0, 0))
+		if _, err := newRepo(db, nopLogger{}, systemClock{}); err != nil {
+			t.Fatal(err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("ping fail", func(t *testing.T) {
+		db, mock, _ := sqlmock.New(sqlmock.MonitorPingsOption(true))
+		defer db.Close()
+
+		mock.ExpectPing().WillReturnError(driver.ErrBadConn)
+		if _, err := newRepo(db, nopLogger{}, systemClock{}); !errors.Is(err, ErrBackendUnavailable) {
+			t.Fatalf("ping fail, err: %v", err)
+		}
+	})
 }
 
 func Test_queryLockRes(t *testing.T) {
-	r, _ := initRepo(user, password, database, ip, port)
+	r, mock := newMockRepo(t)
+	held := &LockTable{ID: 3, Name: key, LockResource: value, Host: host, ExpiredTime: time.Now().Add(time.Minute).Unix(), CreateAt: time.Now()}
 
-	table, err := r.queryLockRes(&LockTable{ LockResource: "38", ExpiredTime: time.Now().UnixNano()})
+	mock.ExpectQuery(querySql).WithArgs(key, sqlmock.AnyArg()).WillReturnRows(lockRows(held))
+	table, err := r.queryLockRes(context.Background(), &LockTable{Name: key})
 	if err != nil {
-		t.Error(err)
-		return
+		t.Fatal(err)
+	}
+	if table.ID != held.ID || table.LockResource != value || table.Host != host || table.ExpiredTime != held.ExpiredTime {
+		t.Fatalf("lock row: %+v, want: %+v", table, held)
+	}
+
+	mock.ExpectQuery(querySql).WithArgs(key, sqlmock.AnyArg()).WillReturnRows(lockRows())
+	if table, err = r.queryLockRes(context.Background(), &LockTable{Name: key}); err != nil || table != nil {
+		t.Fatalf("query free lock, row: %+v, err: %v", table, err)
 	}
-	// output result
-	fmt.Printf("id:%d\name:%s\nhost_ip:%s\nexpire_at:%d\ncreate_at:%s\ndelete_at:%v\n", table.ID, table.LockResource, table.Host, table.ExpiredTime, table.CreateAt, table.DeleteAt)
 }
 
 func Test_insertLockRes(t *testing.T) {
-	r, _ := initRepo(user, password, database, ip, port)
+	clock := newFakeClock()
+	r, mock := newMockRepo(t)
+	r.clock = clock
+	tab := &LockTable{Name: key, LockResource: value, Host: host, Expiration: time.Minute}
+	args := acquireArgs(key, value, host, int64(60), clock.Now().Unix())
 
-	exists, err := r.insertLockRes(&LockTable{
-		LockResource: "uuid",
-		ExpiredTime:  time.Now().UnixNano(),
-		Host:         "10.0.3.37",
-	})
-	if err != nil {
-		t.Error(err)
-		return
+	// new row, token is the id
+	mock.ExpectExec(acquireSql).WithArgs(args...).WillReturnResult(sqlmock.NewResult(7, 1))
+	token, err := r.insertLockRes(context.Background(), tab)
+	if err != nil || token != 7 {
+		t.Fatalf("insert free lock, token: %d, err: %v", token, err)
+	}
+
+	// row alive, nothing changed
+	mock.ExpectExec(acquireSql).WithArgs(args...).WillReturnResult(sqlmock.NewResult(0, 0))
+	if token, err = r.insertLockRes(context.Background(), tab); err != nil || token != 0 {
+		t.Fatalf("insert held lock, token: %d, err: %v", token, err)
+	}
+
+	// released or expired row taken over, token is id + fencing
+	mock.ExpectExec(acquireSql).WithArgs(args...).WillReturnResult(sqlmock.NewResult(8, 2))
+	if token, err = r.insertLockRes(context.Background(), tab); err != nil || token != 8 {
+		t.Fatalf("take over lock, token: %d, err: %v", token, err)
 	}
-	fmt.Println(exists)
 }
 
-func Test_deleteLockRes(t *testing.T) {
-	r, _ := initRepo(user, password, database, ip, port)
+func Test_reentrantLockRes(t *testing.T) {
+	clock := newFakeClock()
+	r, mock := newMockRepo(t)
+	r.clock = clock
+	tab := &LockTable{Name: key, LockResource: value, Host: host, Expiration: time.Minute}
+	args := upsertArgs(reentrantAcquireSql, key, value, host, int64(60), clock.Now().Unix())
+
+	// held by the same value, hold count increased in the same statement, token unchanged
+	mock.ExpectExec(reentrantAcquireSql).WithArgs(args...).WillReturnResult(sqlmock.NewResult(7, 2))
+	if id, err := r.reentrantLockRes(context.Background(), tab); err != nil || id != 7 {
+		t.Fatalf("acquire again, id: %d, err: %v", id, err)
+	}
+
+	// held by others
+	mock.ExpectExec(reentrantAcquireSql).WithArgs(args...).WillReturnResult(sqlmock.NewResult(0, 0))
+	if id, err := r.reentrantLockRes(context.Background(), tab); err != nil || id != 0 {
+		t.Fatalf("acquire held lock, id: %d, err: %v", id, err)
+	}
+}
 
-	affected, err := r.deleteLockRes(1)
+// Test_upsertOnMySQL run acquire statements against a mysql server, sqlmock only compares their text
+// set DLOCK_MYSQL_DSN to run, e.g. root:password@tcp(127.0.0.1:3306)/test?parseTime=true&loc=Local
+func Test_upsertOnMySQL(t *testing.T) {
+	dsn := os.Getenv("DLOCK_MYSQL_DSN")
+	if dsn == "" {
+		t.Skip("DLOCK_MYSQL_DSN not set")
+	}
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	r, err := newRepo(db, nopLogger{}, systemClock{})
 	if err != nil {
-		t.Error(err)
-		return
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	name := fmt.Sprintf("upsert-test-%d", time.Now().UnixNano())
+	defer db.Exec("delete from dlock where name = ?", name)
+	tab := &LockTable{Name: name, LockResource: value, Host: host, Expiration: time.Minute}
+	other := &LockTable{Name: name, LockResource: "other", Host: host, Expiration: time.Minute}
+
+	first, err := r.insertLockRes(ctx, tab)
+	if err != nil || first <= 0 {
+		t.Fatalf("insert free lock, token: %d, err: %v", first, err)
+	}
+	if token, err := r.insertLockRes(ctx, other); err != nil || token != 0 {
+		t.Fatalf("insert held lock, token: %d, err: %v", token, err)
+	}
+
+	// acquired again by the same value with the same token, released after the second release
+	if token, err := r.reentrantLockRes(ctx, tab); err != nil || token != first {
+		t.Fatalf("acquire again, token: %d, want: %d, err: %v", token, first, err)
+	}
+	if token, err := r.reentrantLockRes(ctx, other); err != nil || token != 0 {
+		t.Fatalf("acquire held lock again, token: %d, err: %v", token, err)
+	}
+	for i := 0; i < 2; i++ {
+		if affected, err := r.releaseReentrantLockKey(ctx, name, value); err != nil || affected != 1 {
+			t.Fatalf("release %d, affected: %d, err: %v", i, affected, err)
+		}
+	}
+
+	// released row taken over with a greater token
+	next, err := r.insertLockRes(ctx, other)
+	if err != nil || next <= first {
+		t.Fatalf("take over released lock, token: %d, last: %d, err: %v", next, first, err)
+	}
+
+	// expired row taken over with a greater token
+	if affected, err := r.renewLockKey(ctx, name, "other", -time.Minute); err != nil || affected != 1 {
+		t.Fatalf("expire lock, affected: %d, err: %v", affected, err)
+	}
+	if token, err := r.insertLockRes(ctx, tab); err != nil || token <= next {
+		t.Fatalf("take over expired lock, token: %d, last: %d, err: %v", token, next, err)
 	}
-	fmt.Println(affected)
 }
 
-// MysqlLockType s lock test
-func Test_SLock(t *testing.T) {
-	r, _ := initRepo(user, password, database, ip, port)
+func Test_deleteLockKey(t *testing.T) {
+	r, mock := newMockRepo(t)
 
-	tx, err := r.db.Begin()
-	if err != nil {
-		return
+	mock.ExpectExec(releaseSql).WithArgs(sqlmock.AnyArg(), key, value, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+	if affected, err := r.deleteLockKey(context.Background(), key, value); err != nil || affected != 1 {
+		t.Fatalf("delete held lock, affected: %d, err: %v", affected, err)
 	}
 
-	rows, err := tx.Query(querySql, "aa", "bb", "cc")
-	if err != nil {
-		_ = tx.Rollback()
-		return
+	mock.ExpectExec(releaseSql).WithArgs(sqlmock.AnyArg(), key, "other", sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 0))
+	if affected, err := r.deleteLockKey(context.Background(), key, "other"); err != nil || affected != 0 {
+		t.Fatalf("delete lock of others, affected: %d, err: %v", affected, err)
+	}
+}
+
+func Test_guard(t *testing.T) {
+	r, mock := newMockRepo(t)
+
+	mock.ExpectQuery(getLockSql).WithArgs(guardName(key), 10).WillReturnRows(sqlmock.NewRows([]string{"got"}).AddRow(1))
+	mock.ExpectBegin()
+	mock.ExpectCommit()
+	mock.ExpectExec(releaseLockSql).WithArgs(guardName(key)).WillReturnResult(sqlmock.NewResult(0, 0))
+	if err := r.guard(context.Background(), key, func(*sql.Tx) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+
+	// named lock timeout
+	mock.ExpectQuery(getLockSql).WithArgs(guardName(key), 10).WillReturnRows(sqlmock.NewRows([]string{"got"}).AddRow(0))
+	if err := r.guard(context.Background(), key, func(*sql.Tx) error { return nil }); err == nil {
+		t.Fatal("guard without named lock")
 	}
+}
+
+func Test_runTx(t *testing.T) {
+	r, mock := newMockRepo(t)
+	ctx := context.Background()
 
-	// sleep 10s
-	// then exec "select * from xxx for update" for testing
-	time.Sleep(10 * time.Second)
-	fmt.Println(rows.Next())
+	mock.ExpectBegin()
+	mock.ExpectCommit()
+	if err := r.withTx(ctx, func(*sql.Tx) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+
+	// error of fn returned, rolled back
+	fail := errors.New("fail")
+	mock.ExpectBegin()
+	mock.ExpectRollback()
+	if err := r.withTx(ctx, func(*sql.Tx) error { return fail }); err != fail {
+		t.Fatalf("fn fail, err: %v", err)
+	}
 
-	defer tx.Commit()
+	// rolled back on panic
+	mock.ExpectBegin()
+	mock.ExpectRollback()
+	func() {
+		defer func() {
+			if p := recover(); p != fail {
+				t.Fatalf("panic: %v", p)
+			}
+		}()
+		_ = r.withTx(ctx, func(*sql.Tx) error { panic(fail) })
+	}()
 
-	return
+	// fn not called without transaction
+	mock.ExpectBegin().WillReturnError(fail)
+	if err := r.withTx(ctx, func(*sql.Tx) error {
+		t.Fatal("fn called without transaction")
+		return nil
+	}); err != fail {
+		t.Fatalf("begin fail, err: %v", err)
+	}
+
+	// commit error returned
+	mock.ExpectBegin()
+	mock.ExpectCommit().WillReturnError(fail)
+	if err := r.withTx(ctx, func(*sql.Tx) error { return nil }); err != fail {
+		t.Fatalf("commit fail, err: %v", err)
+	}
+}
+
+func Test_multiLockRes(t *testing.T) {
+	r, mock := newMockRepo(t)
+	tabs := []*LockTable{{Name: "dst", LockResource: value}, {Name: "src", LockResource: value}}
+
+	// locked in order of name, rolled back when one is held
+	mock.ExpectBegin()
+	mock.ExpectExec(acquireSql).WithArgs(acquireArgs("dst", value, "", int64(0), sqlmock.AnyArg())...).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(acquireSql).WithArgs(acquireArgs("src", value, "", int64(0), sqlmock.AnyArg())...).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+	if ids, err := r.multiLockRes(context.Background(), tabs); err != nil || ids != nil {
+		t.Fatalf("lock held keys, ids: %v, err: %v", ids, err)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectExec(acquireSql).WithArgs(acquireArgs("dst", value, "", int64(0), sqlmock.AnyArg())...).WillReturnResult(sqlmock.NewResult(3, 1))
+	mock.ExpectExec(acquireSql).WithArgs(acquireArgs("src", value, "", int64(0), sqlmock.AnyArg())...).WillReturnResult(sqlmock.NewResult(4, 1))
+	mock.ExpectCommit()
+	ids, err := r.multiLockRes(context.Background(), []*LockTable{tabs[1], tabs[0]})
+	if err != nil || len(ids) != 2 || ids[0] != 4 || ids[1] != 3 {
+		t.Fatalf("lock free keys, ids: %v, err: %v", ids, err)
+	}
 }
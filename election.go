@@ -0,0 +1,178 @@
+package dlock
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Election leader election on a lock key, built on Locker
+// the leader holds the lock and renews it in background for as long as it leads
+type Election struct {
+	locker Locker
+	key    string
+	// candidate value of the lock, identify this candidate, see newElection
+	candidate string
+	host      string
+	ttl       time.Duration
+
+	mux  *sync.Mutex
+	lock Lock
+	// leadership change observers
+	observers []chan bool
+}
+
+// candidate lock value of election, identify the leader
+type candidate struct {
+	Value string `json:"value"`
+	Host  string `json:"host"`
+}
+
+// holderReader Locker keeping the host of holder besides the value, mysql only
+// the value of its lock column is limited, so the candidate is not encoded into the value
+type holderReader interface {
+	// getHolder value and host of current holder, "" if not locked
+	getHolder(ctx context.Context, key string) (value, host string, err error)
+}
+
+// NewElection create leader election of key
+// value, host: identify this candidate, returned by Leader
+// ttl: expiration of leadership, renewed every ttl/3 while leading
+// options: other parameter configs, keep alive is always enabled
+func NewElection(key, value, host string, ttl time.Duration, options ...func(*Options)) (*Election, error) {
+	locker, err := NewLocker(append(options, forceKeepAlive)...)
+	if err != nil {
+		return nil, err
+	}
+	return newElection(locker, key, value, host, ttl), nil
+}
+
+// forceKeepAlive enable keep alive, keep the ctx and callback set by WithKeepAlive
+func forceKeepAlive(opts *Options) {
+	opts.KeepAlive = true
+}
+
+// newElection create election on Locker, the Locker must keep alive its locks
+// the lock value is value if the Locker is a holderReader, otherwise the json encoded candidate
+func newElection(locker Locker, key, value, host string, ttl time.Duration) *Election {
+	if _, ok := locker.(holderReader); !ok {
+		encoded, _ := json.Marshal(candidate{Value: value, Host: host})
+		value = string(encoded)
+	}
+	return &Election{
+		locker:    locker,
+		key:       key,
+		candidate: value,
+		host:      host,
+		ttl:       ttl,
+		mux:       &sync.Mutex{},
+	}
+}
+
+// Campaign block until elected or ctx done
+// return nil at once if already the leader
+func (e *Election) Campaign(ctx context.Context) error {
+	if e.IsLeader() {
+		return nil
+	}
+
+	lock, err := e.locker.Lock(ctx, e.ttl, e.key, e.candidate, e.host)
+	if err != nil {
+		return err
+	}
+
+	e.mux.Lock()
+	e.lock = lock
+	e.notify(true)
+	e.mux.Unlock()
+
+	go e.watch(lock)
+	return nil
+}
+
+// Resign give up leadership, nothing to do if not the leader
+func (e *Election) Resign() error {
+	e.mux.Lock()
+	lock := e.lock
+	if lock == nil {
+		e.mux.Unlock()
+		return nil
+	}
+	e.lock = nil
+	e.notify(false)
+	e.mux.Unlock()
+
+	if err := lock.Release(context.Background()); err != nil && !errors.Is(err, ErrNotOwner) {
+		return err
+	}
+	return nil
+}
+
+// Close resign and close the backend connections
+func (e *Election) Close() error {
+	return errors.Join(e.Resign(), e.locker.Close())
+}
+
+// Leader value and host of the current leader, "" if no leader
+func (e *Election) Leader() (value, host string, err error) {
+	if r, ok := e.locker.(holderReader); ok {
+		return r.getHolder(context.Background(), e.key)
+	}
+
+	encoded, err := e.locker.GetValue(context.Background(), e.key)
+	if err != nil || len(encoded) == 0 {
+		return "", "", err
+	}
+
+	var c candidate
+	if err = json.Unmarshal([]byte(encoded), &c); err != nil {
+		// held by a plain lock, not a candidate
+		return encoded, "", nil
+	}
+	return c.Value, c.Host, nil
+}
+
+// IsLeader whether this candidate is the leader
+// false as soon as the lock is lost, even before observers are notified
+func (e *Election) IsLeader() bool {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	return e.lock != nil && !lockLost(e.lock)
+}
+
+// Observe leadership changes of this candidate, true when elected, false when resigned or lost
+// the channel keeps the latest state only, a slow reader skips the states in between
+func (e *Election) Observe() <-chan bool {
+	ch := make(chan bool, 1)
+	e.mux.Lock()
+	e.observers = append(e.observers, ch)
+	e.mux.Unlock()
+	return ch
+}
+
+// watch leadership lost when the lock is lost, Campaign is not retried, call it again to be elected
+func (e *Election) watch(lock Lock) {
+	<-lock.Lost()
+
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	if e.lock == lock {
+		lockLogger(lock).Log(LevelWarn, "leadership lost", "key", e.key)
+		e.lock = nil
+		e.notify(false)
+	}
+}
+
+// notify send leader state to observers, drop the stale state unread
+// must be called with mux held
+func (e *Election) notify(leader bool) {
+	for _, ch := range e.observers {
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- leader
+	}
+}
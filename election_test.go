@@ -0,0 +1,128 @@
+package dlock
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/alicebob/miniredis/v2"
+)
+
+// newMiniElection create Election on an in-process redis server
+func newMiniElection(t *testing.T, mr *miniredis.Miniredis, value string) *Election {
+	l := newMiniRLock(t, mr, forceKeepAlive, WithRetryOption(10*time.Millisecond, 50*time.Millisecond, 0.2))
+	return newElection(l, key, value, host, 300*time.Millisecond)
+}
+
+// observed next leadership state, fail if none in time
+func observed(t *testing.T, ch <-chan bool) bool {
+	select {
+	case leader := <-ch:
+		return leader
+	case <-time.After(time.Second):
+		t.Fatal("no leadership change observed")
+		return false
+	}
+}
+
+func TestElection_Campaign(t *testing.T) {
+	mr := miniredis.RunT(t)
+	a, b := newMiniElection(t, mr, "a"), newMiniElection(t, mr, "b")
+	changes := a.Observe()
+
+	if err := a.Campaign(timeoutCtx(t, time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if !observed(t, changes) || !a.IsLeader() {
+		t.Fatal("a not elected")
+	}
+	if err := a.Campaign(timeoutCtx(t, time.Second)); err != nil {
+		t.Fatalf("campaign again as leader, err: %v", err)
+	}
+
+	// leadership renewed beyond ttl
+	if err := b.Campaign(timeoutCtx(t, 500*time.Millisecond)); err != context.DeadlineExceeded {
+		t.Fatalf("campaign with leader, err: %v", err)
+	}
+	if value, h, err := b.Leader(); err != nil || value != "a" || h != host {
+		t.Fatalf("leader: %s@%s, err: %v", value, h, err)
+	}
+
+	if err := a.Resign(); err != nil {
+		t.Fatal(err)
+	}
+	if observed(t, changes) || a.IsLeader() {
+		t.Fatal("a still leader after resign")
+	}
+	if err := b.Campaign(timeoutCtx(t, time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if value, _, err := a.Leader(); err != nil || value != "b" {
+		t.Fatalf("leader: %s, err: %v", value, err)
+	}
+}
+
+func TestElection_Lost(t *testing.T) {
+	mr := miniredis.RunT(t)
+	e := newMiniElection(t, mr, "a")
+	changes := e.Observe()
+
+	if err := e.Campaign(timeoutCtx(t, time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if !observed(t, changes) {
+		t.Fatal("not elected")
+	}
+
+	// lock taken over behind the leader, renewal fails
+	mr.Set(key, "other")
+	if observed(t, changes) || e.IsLeader() {
+		t.Fatal("leadership not lost")
+	}
+	if err := e.Resign(); err != nil {
+		t.Fatalf("resign after lost, err: %v", err)
+	}
+}
+
+func TestElection_CampaignAfterLost(t *testing.T) {
+	mr := miniredis.RunT(t)
+	e := newMiniElection(t, mr, "a")
+
+	// lock lost, not yet seen by watch
+	lost := newHandle(key, e.candidate, 1, time.Minute, &countHolder{}, Options{})
+	lost.markLost()
+	e.lock = lost
+	if e.IsLeader() {
+		t.Fatal("leader with lost lock")
+	}
+
+	if err := e.Campaign(timeoutCtx(t, time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if !e.IsLeader() || !mr.Exists(key) {
+		t.Fatal("campaign returned without lock")
+	}
+}
+
+func TestElection_MySQL(t *testing.T) {
+	r, mock := newMockRepo(t)
+	e := newElection(&mLock{repo: r, opts: Options{KeepAlive: true}}, key, value, host, time.Minute)
+	anyArg := sqlmock.AnyArg()
+
+	// value and host are stored in their own columns, not encoded into lock_resource
+	mock.ExpectExec(acquireSql).WithArgs(acquireArgs(key, value, host, int64(60), anyArg)...).WillReturnResult(sqlmock.NewResult(3, 1))
+	if err := e.Campaign(timeoutCtx(t, time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	mock.ExpectQuery(querySql).WithArgs(key, anyArg).WillReturnRows(lockRows(&LockTable{ID: 3, Name: key, LockResource: value, Host: host}))
+	if v, h, err := e.Leader(); err != nil || v != value || h != host {
+		t.Fatalf("leader: %s@%s, err: %v", v, h, err)
+	}
+
+	mock.ExpectExec(releaseSql).WithArgs(anyArg, key, value, anyArg).WillReturnResult(sqlmock.NewResult(0, 1))
+	if err := e.Resign(); err != nil {
+		t.Fatal(err)
+	}
+}
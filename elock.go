@@ -0,0 +1,252 @@
+package dlock
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"math"
+	"os"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	"go.etcd.io/etcd/client/pkg/v3/transport"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+)
+
+// eLock etcd lock
+// every Acquire grants a lease and puts key/<lease id> under it,
+// the key with the smallest create revision holds the lock
+type eLock struct {
+	client *clientv3.Client
+	opts   Options
+}
+
+// etcdHolder lock held by lease
+type etcdHolder struct {
+	client *clientv3.Client
+	lease  clientv3.LeaseID
+}
+
+// NewELock create etcd distributed lock
+// options: other parameter configs
+func NewELock(opts Options) (*eLock, error) {
+	// require check
+	if err := NewValidate().
+		SliceEmpty(opts.Cluster, "etcd endpoints").
+		ToError(); err != nil {
+		return nil, err
+	}
+	if opts.Reentrant {
+		return nil, fmt.Errorf("reentrant %s lock: %w", EtcdLockType, NotSupportedTypeLockErr)
+	}
+
+	tlsConfig, err := etcdTLSConfig(opts)
+	if err != nil {
+		return nil, fmt.Errorf("load etcd tls config fail, err: %v", err)
+	}
+
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   opts.Cluster,
+		DialTimeout: opts.DialTimeout,
+		Username:    opts.User,
+		Password:    opts.Password,
+		TLS:         tlsConfig,
+		// silent like the default Logger, failures are returned and logged by opts.logger()
+		Logger: zap.NewNop(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// status check, like redis ping, any reachable endpoint is enough
+	if err := etcdStatus(client, opts.Cluster, etcdRequestTimeout(opts.DialTimeout)); err != nil {
+		opts.logger().Log(LevelError, "etcd client status check fail", "endpoints", opts.Cluster, "err", err)
+		_ = client.Close()
+		return nil, unavailableErr(err)
+	}
+
+	return &eLock{
+		client: client,
+		opts:   opts,
+	}, nil
+}
+
+// Acquire 获取锁
+// return ErrLockHeld if held by others, or waiters of fair Lock are queued before
+// return ErrNoExpiration if expiration <= 0, a lease always expires
+func (l *eLock) Acquire(ctx context.Context, expiration time.Duration, key, value, host string) (Lock, error) {
+	if expiration <= 0 {
+		return nil, noExpirationErr(key, expiration)
+	}
+	lease, err := l.client.Grant(ctx, etcdTTL(expiration))
+	if err != nil {
+		return nil, backendErr(key, err)
+	}
+
+	// put own key and read the first created key of prefix in one txn
+	ownKey := etcdLeaseKey(key, lease.ID)
+	resp, err := l.client.Txn(ctx).
+		Then(
+			clientv3.OpPut(ownKey, value, clientv3.WithLease(lease.ID)),
+			clientv3.OpGet(etcdPrefix(key), clientv3.WithFirstCreate()...),
+		).Commit()
+	if err != nil {
+		// ctx may be done, revoke in background
+		_, _ = l.client.Revoke(context.Background(), lease.ID)
+		return nil, backendErr(key, err)
+	}
+
+	kvs := resp.Responses[1].GetResponseRange().Kvs
+	if len(kvs) == 0 || string(kvs[0].Key) != ownKey {
+		// held by others, drop own key
+		if _, err = l.client.Revoke(context.Background(), lease.ID); err != nil {
+			return nil, backendErr(key, err)
+		}
+		return nil, heldErr(key)
+	}
+
+	// create revision of own key is the fencing token
+	revision := resp.Responses[0].GetResponsePut().Header.Revision
+	return newHandle(key, value, revision, expiration, &etcdHolder{client: l.client, lease: lease.ID}, l.opts), nil
+}
+
+// Lock block until the lock is acquired or ctx done
+// fair: keep own key while waiting, granted in order of create revision
+func (l *eLock) Lock(ctx context.Context, expiration time.Duration, key, value, host string) (Lock, error) {
+	if expiration <= 0 {
+		return nil, noExpirationErr(key, expiration)
+	}
+	if l.opts.Fair {
+		return l.fairLock(ctx, expiration, key, value)
+	}
+	return waitLock(ctx, l.opts, key, func(ctx context.Context) (Lock, error) {
+		return l.Acquire(ctx, expiration, key, value, host)
+	})
+}
+
+// GetValue  get lock value, "" if not locked
+func (l *eLock) GetValue(ctx context.Context, key string) (string, error) {
+	resp, err := l.client.Get(ctx, etcdPrefix(key), clientv3.WithFirstCreate()...)
+	if err != nil || len(resp.Kvs) == 0 {
+		return "", backendErr(key, err)
+	}
+	return string(resp.Kvs[0].Value), nil
+}
+
+// GetType  get lock type
+func (l *eLock) GetType() string {
+	return EtcdLockType
+}
+
+// Close close etcd client, leases of locks held expire after their ttl
+func (l *eLock) Close() error {
+	return l.client.Close()
+}
+
+// release revoke the lease, key attached will be deleted by etcd
+func (h *etcdHolder) release(ctx context.Context) error {
+	_, err := h.client.Revoke(ctx, h.lease)
+	return etcdLeaseErr(err)
+}
+
+// refresh keep the lease alive once
+// etcd lease ttl is fixed on grant, refresh to the granted ttl
+func (h *etcdHolder) refresh(ctx context.Context, expiration time.Duration) error {
+	_, err := h.client.KeepAliveOnce(ctx, h.lease)
+	return etcdLeaseErr(err)
+}
+
+// ttl remaining ttl of the lease
+func (h *etcdHolder) ttl(ctx context.Context) (time.Duration, error) {
+	resp, err := h.client.TimeToLive(ctx, h.lease)
+	if err != nil {
+		return 0, etcdLeaseErr(err)
+	}
+	if resp.TTL < 0 {
+		return 0, ErrNotOwner
+	}
+	return time.Duration(resp.TTL) * time.Second, nil
+}
+
+// etcdLeaseErr lease not found means the lock is lost
+func etcdLeaseErr(err error) error {
+	if err == rpctypes.ErrLeaseNotFound {
+		return ErrNotOwner
+	}
+	return err
+}
+
+// etcdPrefix all waiters of key are put under this prefix
+func etcdPrefix(key string) string {
+	return key + "/"
+}
+
+// etcdLeaseKey key owned by lease
+func etcdLeaseKey(key string, id clientv3.LeaseID) string {
+	return fmt.Sprintf("%s%x", etcdPrefix(key), id)
+}
+
+// etcdTTL lease ttl in seconds, at least 1s
+func etcdTTL(expiration time.Duration) int64 {
+	ttl := int64(math.Ceil(expiration.Seconds()))
+	if ttl < 1 {
+		ttl = 1
+	}
+	return ttl
+}
+
+// etcdRequestTimeout timeout of status check, default 5s
+func etcdRequestTimeout(dialTimeout time.Duration) time.Duration {
+	if dialTimeout <= 0 {
+		return 5 * time.Second
+	}
+	return dialTimeout
+}
+
+// etcdStatus check status of endpoints one by one, each within timeout
+// return nil once an endpoint is reachable, otherwise the error of the last one
+func etcdStatus(client *clientv3.Client, endpoints []string, timeout time.Duration) error {
+	var err error
+	for _, endpoint := range endpoints {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		_, err = client.Status(ctx, endpoint)
+		cancel()
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// etcdTLSConfig build tls config from options
+// return nil if no tls option set
+func etcdTLSConfig(opts Options) (*tls.Config, error) {
+	if len(opts.CertFile) > 0 || len(opts.KeyFile) > 0 {
+		info := transport.TLSInfo{
+			CertFile:           opts.CertFile,
+			KeyFile:            opts.KeyFile,
+			TrustedCAFile:      opts.CAFile,
+			InsecureSkipVerify: opts.SkipSSL,
+		}
+		return info.ClientConfig()
+	}
+
+	if len(opts.CAFile) <= 0 && !opts.SkipSSL {
+		return nil, nil
+	}
+
+	config := &tls.Config{InsecureSkipVerify: opts.SkipSSL}
+	if len(opts.CAFile) > 0 {
+		pem, err := os.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", opts.CAFile)
+		}
+	}
+	return config, nil
+}
@@ -0,0 +1,196 @@
+package dlock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"go.etcd.io/etcd/server/v3/embed"
+)
+
+// startEtcd start an embedded etcd server, return client endpoint
+func startEtcd(t *testing.T) string {
+	cfg := embed.NewConfig()
+	cfg.Dir = t.TempDir()
+	cfg.LogLevel = "error"
+
+	clientURL, peerURL := localURL(t), localURL(t)
+	cfg.ListenClientUrls = []url.URL{clientURL}
+	cfg.AdvertiseClientUrls = []url.URL{clientURL}
+	cfg.ListenPeerUrls = []url.URL{peerURL}
+	cfg.AdvertisePeerUrls = []url.URL{peerURL}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(e.Close)
+
+	select {
+	case <-e.Server.ReadyNotify():
+	case <-time.After(10 * time.Second):
+		t.Fatal("embedded etcd start timeout")
+	}
+	return clientURL.Host
+}
+
+// localURL pick a free local port
+func localURL(t *testing.T) url.URL {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return url.URL{Scheme: "http", Host: l.Addr().String()}
+}
+
+func TestELock_Acquire(t *testing.T) {
+	endpoint := startEtcd(t)
+
+	l, err := NewDLock(WithEtcdOption(dialTimeout*10, endpoint))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewDLock(WithEtcdOption(dialTimeout*10, endpoint))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	success, err := l.Acquire(5*time.Minute, key, value, host)
+	if err != nil || !success {
+		t.Fatalf("acquire fail, success: %t, err: %v", success, err)
+	}
+
+	// held by l
+	success, err = other.Acquire(5*time.Minute, key, "other", host)
+	if err != nil || success {
+		t.Fatalf("acquire held lock, success: %t, err: %v", success, err)
+	}
+
+	locked, err := other.IsLock(key)
+	if err != nil || !locked {
+		t.Fatalf("lock status: %t, err: %v", locked, err)
+	}
+	if v := other.GetValue(key); v != value {
+		t.Fatalf("lock value: %s, want: %s", v, value)
+	}
+
+	token := l.GetToken(key)
+	if token <= 0 || other.GetToken(key) != 0 {
+		t.Fatalf("token: %d, other token: %d", token, other.GetToken(key))
+	}
+
+	if err = other.UnLock(key); err != ErrNotOwner {
+		t.Fatalf("unlock by other, err: %v", err)
+	}
+	if err = l.UnLock(key); err != nil {
+		t.Fatal(err)
+	}
+	if locked, _ = other.IsLock(key); locked {
+		t.Fatal("lock still held after unlock")
+	}
+
+	success, err = other.Acquire(5*time.Minute, key, "other", host)
+	if err != nil || !success {
+		t.Fatalf("acquire released lock, success: %t, err: %v", success, err)
+	}
+	if next := other.GetToken(key); next <= token {
+		t.Fatalf("token not increased, %d -> %d", token, next)
+	}
+	t.Logf("lock status : %t, value :%s", success, other.GetValue(key))
+
+	// a lease always expires, no lock without expiration
+	if _, err = l.Acquire(0, "forever", value, host); !errors.Is(err, ErrNoExpiration) {
+		t.Fatalf("acquire without expiration, err: %v", err)
+	}
+	if err = l.Lock(context.Background(), 0, "forever", value, host); !errors.Is(err, ErrNoExpiration) {
+		t.Fatalf("lock without expiration, err: %v", err)
+	}
+}
+
+func TestELock_EndpointDown(t *testing.T) {
+	endpoint := startEtcd(t)
+	down := localURL(t).Host
+
+	// first endpoint down, status checked on the next one
+	l, err := NewDLock(WithEtcdOption(dialTimeout*10, down, endpoint))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if success, err := l.Acquire(time.Minute, key, value, host); err != nil || !success {
+		t.Fatalf("acquire fail, success: %t, err: %v", success, err)
+	}
+
+	if _, err = NewDLock(WithEtcdOption(dialTimeout*10, down)); !errors.Is(err, ErrBackendUnavailable) {
+		t.Fatalf("all endpoints down, err: %v", err)
+	}
+}
+
+func TestELock_Concurrent(t *testing.T) {
+	endpoint := startEtcd(t)
+
+	const workers = 10
+	results := make(chan bool, workers)
+	for i := 0; i < workers; i++ {
+		l, err := NewDLock(WithEtcdOption(dialTimeout*10, endpoint))
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func(i int) {
+			success, err := l.Acquire(5*time.Minute, key, fmt.Sprintf("worker-%d", i), host)
+			if err != nil {
+				t.Error(err)
+			}
+			results <- success
+		}(i)
+	}
+
+	held := 0
+	for i := 0; i < workers; i++ {
+		if <-results {
+			held++
+		}
+	}
+	if held != 1 {
+		t.Fatalf("%d workers hold the lock", held)
+	}
+}
+
+func TestELock_Lock(t *testing.T) {
+	endpoint := startEtcd(t)
+
+	l, err := NewDLock(WithEtcdOption(dialTimeout*10, endpoint))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewDLock(
+		WithEtcdOption(dialTimeout*10, endpoint),
+		WithRetryOption(10*time.Millisecond, 50*time.Millisecond, 0.2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if success, err := l.Acquire(5*time.Minute, key, value, host); err != nil || !success {
+		t.Fatalf("acquire fail, success: %t, err: %v", success, err)
+	}
+
+	time.AfterFunc(100*time.Millisecond, func() {
+		if err := l.UnLock(key); err != nil {
+			t.Error(err)
+		}
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err = other.Lock(ctx, 5*time.Minute, key, "other", host); err != nil {
+		t.Fatal(err)
+	}
+	if v := l.GetValue(key); v != "other" {
+		t.Fatalf("lock value: %s, want: other", v)
+	}
+}
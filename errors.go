@@ -0,0 +1,76 @@
+package dlock
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// errors returned by all backends, check them with errors.Is
+var (
+	NotSupportedTypeLockErr = fmt.Errorf("not support this type distibuted lock")
+	// ErrLockHeld lock is held by others, returned by Acquire of Locker when contended
+	ErrLockHeld = errors.New("lock is held by others")
+	// ErrNotOwner lock is not held, or held by another value
+	ErrNotOwner = errors.New("lock is not held by this owner")
+	// ErrLockExpired lock is lost after its expire time, it is also ErrNotOwner
+	ErrLockExpired = fmt.Errorf("lock is expired, %w", ErrNotOwner)
+	// ErrBackendUnavailable backend can not be reached, the original error is wrapped too
+	ErrBackendUnavailable = errors.New("lock backend is unavailable")
+	// ErrNoExpiration expiration <= 0 on a backend or lock that must expire, it is also NotSupportedTypeLockErr
+	ErrNoExpiration = fmt.Errorf("lock without expiration, %w", NotSupportedTypeLockErr)
+)
+
+// heldErr ErrLockHeld of key
+func heldErr(key string) error {
+	return fmt.Errorf("lock %s: %w", key, ErrLockHeld)
+}
+
+// noExpirationErr ErrNoExpiration of key
+func noExpirationErr(key string, expiration time.Duration) error {
+	return fmt.Errorf("lock %s expiration %s: %w", key, expiration, ErrNoExpiration)
+}
+
+// backendErr error of backend operation on key
+// connection failures are wrapped as ErrBackendUnavailable, others return as it is
+func backendErr(key string, err error) error {
+	if err == nil || !isUnavailable(err) || errors.Is(err, ErrBackendUnavailable) {
+		return err
+	}
+	return fmt.Errorf("lock %s: %w: %w", key, ErrBackendUnavailable, err)
+}
+
+// unavailableErr backend can not be reached on creation
+func unavailableErr(err error) error {
+	if err == nil || errors.Is(err, ErrBackendUnavailable) {
+		return err
+	}
+	return fmt.Errorf("%w: %w", ErrBackendUnavailable, err)
+}
+
+// isUnavailable connection failure of redis, mysql or etcd
+// context done is the caller's choice, not a backend failure
+func isUnavailable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var netErr net.Error
+	switch {
+	case errors.As(err, &netErr),
+		errors.Is(err, io.EOF),
+		errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, driver.ErrBadConn),
+		errors.Is(err, mysql.ErrInvalidConn):
+		return true
+	}
+	return status.Code(err) == codes.Unavailable
+}
@@ -0,0 +1,71 @@
+package dlock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestBackendErr(t *testing.T) {
+	opErr := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	cases := []struct {
+		err         error
+		unavailable bool
+	}{
+		{opErr, true},
+		{io.EOF, true},
+		{fmt.Errorf("read: %w", io.ErrUnexpectedEOF), true},
+		{status.Error(codes.Unavailable, "no leader"), true},
+		{context.DeadlineExceeded, false},
+		{errors.New("ERR script error"), false},
+		{heldErr(key), false},
+	}
+	for _, c := range cases {
+		err := backendErr(key, c.err)
+		if errors.Is(err, ErrBackendUnavailable) != c.unavailable {
+			t.Errorf("err: %v, unavailable: %t", c.err, !c.unavailable)
+		}
+		if !errors.Is(err, c.err) {
+			t.Errorf("original error %v not wrapped", c.err)
+		}
+	}
+
+	var netErr *net.OpError
+	if !errors.As(backendErr(key, opErr), &netErr) {
+		t.Error("errors.As original error fail")
+	}
+}
+
+func TestErrors_Redis(t *testing.T) {
+	mr := miniredis.RunT(t)
+	l := newMiniRLock(t, mr)
+	ctx := context.Background()
+
+	lock, err := l.Acquire(ctx, 100*time.Millisecond, key, value, host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = l.Acquire(ctx, time.Minute, key, "other", host); !errors.Is(err, ErrLockHeld) {
+		t.Fatalf("contention, err: %v", err)
+	}
+
+	// expired on server and local clock
+	time.Sleep(100 * time.Millisecond)
+	mr.FastForward(time.Second)
+	if err = lock.Refresh(ctx, time.Minute); !errors.Is(err, ErrLockExpired) || !errors.Is(err, ErrNotOwner) {
+		t.Fatalf("refresh expired lock, err: %v", err)
+	}
+
+	mr.Close()
+	if _, err = l.Acquire(ctx, time.Minute, key, value, host); !errors.Is(err, ErrBackendUnavailable) {
+		t.Fatalf("redis down, err: %v", err)
+	}
+}
@@ -0,0 +1,204 @@
+package dlock
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// fairQueue backend of fair lock, waiters are identified by a unique id
+type fairQueue interface {
+	// tryFair acquire only if id is the head of the queue, or the queue is empty
+	// wait > 0: enqueue id if absent, and keep it in the queue for wait
+	tryFair(ctx context.Context, expiration, wait time.Duration, key, value, host, id string) (Lock, error)
+	// dequeue remove id from the queue
+	dequeue(ctx context.Context, key, id string) error
+}
+
+// waitFair wait in the queue of key until the lock is acquired or ctx done
+// the waiter is dropped from the queue if it does not poll again within 2 max retry intervals
+func waitFair(ctx context.Context, opts Options, q fairQueue, expiration time.Duration, key, value, host string) (Lock, error) {
+	id := holderID()
+	wait := 2 * newBackoff(opts).max
+	lock, err := waitLock(ctx, opts, key, func(ctx context.Context) (Lock, error) {
+		return q.tryFair(ctx, expiration, wait, key, value, host, id)
+	})
+	if err != nil {
+		// ctx is done, leave the queue in background
+		if err := q.dequeue(context.Background(), key, id); err != nil {
+			opts.logger().Log(LevelWarn, "dequeue waiter fail", "key", key, "err", err)
+		}
+		return nil, err
+	}
+	return lock, nil
+}
+
+var (
+	// fairAcquireScript
+	// KEYS[1]: lock key, KEYS[2]: fencing key, KEYS[3]: queue, KEYS[4]: queue timeout, KEYS[5]: queue sequence
+	// ARGV[1]: value, ARGV[2]: expiration ms, ARGV[3]: waiter id, ARGV[4]: wait ms, 0 not enqueue
+	// queue: sorted set of waiter id by arrival sequence; queue timeout: sorted set of waiter id by expire time ms
+	// return fencing token, 0 if held or not the head of queue
+	fairAcquireScript = redis.NewScript(fencingPrelude + `
+local t = redis.call("time")
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+for _, id in ipairs(redis.call("zrangebyscore", KEYS[4], "-inf", now)) do
+	redis.call("zrem", KEYS[3], id)
+	redis.call("zrem", KEYS[4], id)
+end
+
+local wait = tonumber(ARGV[4])
+if wait > 0 then
+	if not redis.call("zscore", KEYS[3], ARGV[3]) then
+		redis.call("zadd", KEYS[3], redis.call("incr", KEYS[5]), ARGV[3])
+	end
+	redis.call("zadd", KEYS[4], now + wait, ARGV[3])
+	for i = 3, 5 do
+		if redis.call("pttl", KEYS[i]) < wait then
+			redis.call("pexpire", KEYS[i], wait)
+		end
+	end
+end
+
+local head = redis.call("zrange", KEYS[3], 0, 0)[1]
+if head and head ~= ARGV[3] then
+	return 0
+end
+
+local ok
+if tonumber(ARGV[2]) > 0 then
+	ok = redis.call("set", KEYS[1], ARGV[1], "NX", "PX", ARGV[2])
+else
+	ok = redis.call("set", KEYS[1], ARGV[1], "NX")
+end
+if not ok then
+	return 0
+end
+redis.call("zrem", KEYS[3], ARGV[3])
+redis.call("zrem", KEYS[4], ARGV[3])
+return nextToken(KEYS[2])
+`)
+
+	// fairDequeueScript KEYS[1]: queue, KEYS[2]: queue timeout, ARGV[1]: waiter id
+	fairDequeueScript = redis.NewScript(`
+redis.call("zrem", KEYS[1], ARGV[1])
+return redis.call("zrem", KEYS[2], ARGV[1])
+`)
+)
+
+// fairKeys lock key, fencing key and queue keys of key
+func fairKeys(key string) []string {
+	return []string{key, fencingKey(key), tagKey(key, "queue"), tagKey(key, "queue:timeout"), tagKey(key, "queue:seq")}
+}
+
+// tryFair set key if id is the head of the queue
+// the lock held is a plain string key, released like the unfair lock
+func (l *rLock) tryFair(ctx context.Context, expiration, wait time.Duration, key, value, host, id string) (Lock, error) {
+	token, err := fairAcquireScript.Run(withContext(ctx, l.rc), fairKeys(key), value, expiration.Milliseconds(), id, wait.Milliseconds()).Int64()
+	if err != nil {
+		return nil, backendErr(key, err)
+	}
+	if token <= 0 {
+		return nil, heldErr(key)
+	}
+	return newHandle(key, value, token, expiration, &redisHolder{rc: l.rc, scripts: plainScripts, key: key, value: value}, l.opts), nil
+}
+
+// dequeue remove waiter id
+func (l *rLock) dequeue(ctx context.Context, key, id string) error {
+	return fairDequeueScript.Run(withContext(ctx, l.rc), fairKeys(key)[2:4], id).Err()
+}
+
+// tryFair insert lock row if waiter row of id is the first one alive
+func (l *mLock) tryFair(ctx context.Context, expiredTime, wait time.Duration, key, value, host, id string) (Lock, error) {
+	tab := &LockTable{Name: key, LockResource: value, Expiration: expiredTime, Host: host}
+	var waiting *LockTable
+	if wait > 0 {
+		waiting = &LockTable{Name: holderRowName(key, "q", id), LockResource: value, Expiration: wait, Host: host}
+	}
+
+	token, err := l.repo.fairLockRes(ctx, key, tab, waiting)
+	if err != nil {
+		return nil, backendErr(key, err)
+	}
+	if token <= 0 {
+		return nil, heldErr(key)
+	}
+	return newHandle(key, value, token, expiredTime, &mysqlHolder{repo: l.repo, token: token, key: key, value: value}, l.opts), nil
+}
+
+// dequeue soft delete waiter row
+func (l *mLock) dequeue(ctx context.Context, key, id string) error {
+	return l.repo.cancelWaitRes(ctx, holderRowName(key, "q", id))
+}
+
+// fairLock put own key under a new lease, then wait until all keys created before are deleted
+// the lease is kept alive while waiting, revoked if ctx done so the waiter leaves the queue
+func (l *eLock) fairLock(ctx context.Context, expiration time.Duration, key, value string) (Lock, error) {
+	lease, err := l.client.Grant(ctx, etcdTTL(expiration))
+	if err != nil {
+		return nil, backendErr(key, err)
+	}
+
+	resp, err := l.client.Put(ctx, etcdLeaseKey(key, lease.ID), value, clientv3.WithLease(lease.ID))
+	if err == nil {
+		err = l.waitDeletes(ctx, key, resp.Header.Revision, lease.ID, expiration)
+	}
+	if err != nil {
+		_, _ = l.client.Revoke(context.Background(), lease.ID)
+		return nil, backendErr(key, err)
+	}
+	return newHandle(key, value, resp.Header.Revision, expiration, &etcdHolder{client: l.client, lease: lease.ID}, l.opts), nil
+}
+
+// waitDeletes wait until no key of prefix created before revision
+func (l *eLock) waitDeletes(ctx context.Context, key string, revision int64, lease clientv3.LeaseID, expiration time.Duration) error {
+	keepAlive := time.NewTicker(time.Duration(etcdTTL(expiration)) * time.Second / 3)
+	defer keepAlive.Stop()
+
+	for {
+		opts := append(clientv3.WithLastCreate(), clientv3.WithMaxCreateRev(revision-1))
+		resp, err := l.client.Get(ctx, etcdPrefix(key), opts...)
+		if err != nil {
+			return err
+		}
+		if len(resp.Kvs) == 0 {
+			return nil
+		}
+
+		// wait the last waiter before, the ones before it are deleted by then or waited next round
+		if err = l.waitDelete(ctx, string(resp.Kvs[0].Key), resp.Header.Revision, lease, keepAlive.C); err != nil {
+			return err
+		}
+	}
+}
+
+// waitDelete wait key deleted after revision, keep lease alive on every tick
+func (l *eLock) waitDelete(ctx context.Context, key string, revision int64, lease clientv3.LeaseID, tick <-chan time.Time) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	watch := l.client.Watch(ctx, key, clientv3.WithRev(revision+1))
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-tick:
+			if _, err := l.client.KeepAliveOnce(ctx, lease); err != nil {
+				return etcdLeaseErr(err)
+			}
+		case resp, ok := <-watch:
+			if !ok || resp.Err() != nil {
+				// watch broken, check again
+				return ctx.Err()
+			}
+			for _, ev := range resp.Events {
+				if ev.Type == clientv3.EventTypeDelete {
+					return nil
+				}
+			}
+		}
+	}
+}
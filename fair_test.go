@@ -0,0 +1,187 @@
+package dlock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/alicebob/miniredis/v2"
+)
+
+// testFairOrder waiters queued one by one must be granted in the same order
+func testFairOrder(t *testing.T, holder Locker, waiters []Locker) {
+	ctx := timeoutCtx(t, 10*time.Second)
+	lock, err := holder.Lock(ctx, time.Minute, key, value, host)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	granted := make(chan int, len(waiters))
+	for i, w := range waiters {
+		go func(i int, w Locker) {
+			lock, err := w.Lock(ctx, time.Minute, key, fmt.Sprintf("waiter-%d", i), host)
+			if err != nil {
+				t.Error(err)
+				granted <- -1
+				return
+			}
+			granted <- i
+			time.Sleep(20 * time.Millisecond)
+			_ = lock.Release(context.Background())
+		}(i, w)
+		// let waiter i enqueue before the next one
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if err = lock.Release(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for want := range waiters {
+		if got := <-granted; got != want {
+			t.Fatalf("granted waiter %d, want %d", got, want)
+		}
+	}
+}
+
+func TestFair_Redis(t *testing.T) {
+	mr := miniredis.RunT(t)
+	newLocker := func() Locker {
+		return newMiniRLock(t, mr, WithFair(), WithRetryOption(10*time.Millisecond, 50*time.Millisecond, 0.2))
+	}
+
+	var waiters []Locker
+	for i := 0; i < 4; i++ {
+		waiters = append(waiters, newLocker())
+	}
+	testFairOrder(t, newLocker(), waiters)
+	if queue := tagKey(key, "queue"); mr.Exists(queue) {
+		members, _ := mr.ZMembers(queue)
+		t.Fatalf("queue not empty: %v", members)
+	}
+}
+
+func TestFair_RedisTimeout(t *testing.T) {
+	mr := miniredis.RunT(t)
+	ctx := context.Background()
+	holder := newMiniRLock(t, mr, WithFair(), WithRetryOption(10*time.Millisecond, 50*time.Millisecond, 0.2))
+	waiter := newMiniRLock(t, mr, WithFair(), WithRetryOption(10*time.Millisecond, 50*time.Millisecond, 0.2))
+
+	lock, err := holder.Acquire(ctx, time.Minute, key, value, host)
+	if err != nil || lock == nil {
+		t.Fatalf("acquire, lock: %v, err: %v", lock, err)
+	}
+
+	// waiter gives up and leaves the queue
+	if _, err = waiter.Lock(timeoutCtx(t, 100*time.Millisecond), time.Minute, key, "waiter", host); err != context.DeadlineExceeded {
+		t.Fatalf("lock held, err: %v", err)
+	}
+	if members, _ := mr.ZMembers(tagKey(key, "queue")); len(members) > 0 {
+		t.Fatalf("waiter not dequeued: %v", members)
+	}
+
+	// a queued waiter is served before Acquire
+	locked := make(chan error, 1)
+	go func() {
+		lock, err := waiter.Lock(timeoutCtx(t, 5*time.Second), time.Minute, key, "waiter", host)
+		if err == nil && lock.Value() != "waiter" {
+			err = fmt.Errorf("lock value: %s", lock.Value())
+		}
+		locked <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if err = lock.Release(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if jumped, err := holder.Acquire(ctx, time.Minute, key, value, host); !errors.Is(err, ErrLockHeld) || jumped != nil {
+		t.Fatalf("acquire ahead of waiter, lock: %v, err: %v", jumped, err)
+	}
+	if err = <-locked; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFair_Etcd(t *testing.T) {
+	endpoint := startEtcd(t)
+	newLocker := func() Locker {
+		l, err := NewLocker(WithEtcdOption(dialTimeout*10, endpoint), WithFair())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return l
+	}
+
+	var waiters []Locker
+	for i := 0; i < 3; i++ {
+		waiters = append(waiters, newLocker())
+	}
+	testFairOrder(t, newLocker(), waiters)
+
+	// waiter timeout revoke its lease, the key is dropped from the queue
+	l := newLocker()
+	lock, err := l.Lock(timeoutCtx(t, time.Second), time.Minute, key, value, host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = newLocker().Lock(timeoutCtx(t, 100*time.Millisecond), time.Minute, key, "waiter", host); err != context.DeadlineExceeded {
+		t.Fatalf("lock held, err: %v", err)
+	}
+	if err = lock.Release(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if lock, err = l.Acquire(context.Background(), time.Minute, key, value, host); err != nil || lock == nil {
+		t.Fatalf("acquire after waiter timeout, lock: %v, err: %v", lock, err)
+	}
+}
+
+func TestFair_MySQL(t *testing.T) {
+	clock := newFakeClock()
+	r, mock := newMockRepo(t)
+	r.clock = clock
+	l := &mLock{repo: r, opts: Options{Fair: true, Clock: clock}}
+	ctx := context.Background()
+	now := clock.Now().Unix()
+	anyArg := sqlmock.AnyArg()
+	head := func(name string) *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"name"}).AddRow(name)
+	}
+
+	// a queued waiter blocks Acquire even if the lock is free
+	expectGuard(mock, key, func() {
+		mock.ExpectQuery(queueHeadSql).WithArgs(prefixArg(key, "q"), now).WillReturnRows(head(holderRowName(key, "q", holderID())))
+	})
+	if lock, err := l.Acquire(ctx, time.Minute, key, value, host); !errors.Is(err, ErrLockHeld) || lock != nil {
+		t.Fatalf("acquire ahead of waiter, lock: %v, err: %v", lock, err)
+	}
+
+	// waiter enqueued behind the head
+	id := holderID()
+	waiting := holderRowName(key, "q", id)
+	expectGuard(mock, key, func() {
+		mock.ExpectQuery(aliveSql).WithArgs(waiting, now).WillReturnRows(countRows(0))
+		mock.ExpectExec(deleteDeadSql).WithArgs(waiting, now).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec(acquireSql).WithArgs(acquireArgs(waiting, "waiter", host, int64(1), now)...).WillReturnResult(sqlmock.NewResult(4, 1))
+		mock.ExpectQuery(queueHeadSql).WithArgs(prefixArg(key, "q"), now).WillReturnRows(head(holderRowName(key, "q", holderID())))
+	})
+	if _, err := l.tryFair(ctx, time.Minute, time.Second, key, "waiter", host, id); !errors.Is(err, ErrLockHeld) {
+		t.Fatalf("lock behind head, err: %v", err)
+	}
+
+	// the head expired, queueHeadSql skips it by now, the waiter is the head and acquires
+	clock.Add(time.Minute)
+	now = clock.Now().Unix()
+	expectGuard(mock, key, func() {
+		mock.ExpectQuery(aliveSql).WithArgs(waiting, now).WillReturnRows(countRows(1))
+		mock.ExpectExec(renewSql).WithArgs(int64(1), now, waiting, "waiter", now).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectQuery(queueHeadSql).WithArgs(prefixArg(key, "q"), now).WillReturnRows(head(waiting))
+		mock.ExpectQuery(aliveSql).WithArgs(key, now).WillReturnRows(countRows(0))
+		mock.ExpectExec(cancelWaitSql).WithArgs(anyArg, waiting).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(acquireSql).WithArgs(acquireArgs(key, "waiter", host, int64(60), now)...).WillReturnResult(sqlmock.NewResult(5, 1))
+	})
+	lock, err := l.tryFair(ctx, time.Minute, time.Second, key, "waiter", host, id)
+	if err != nil || lock.Token() != 5 {
+		t.Fatalf("lock as head, lock: %v, err: %v", lock, err)
+	}
+}
@@ -0,0 +1,219 @@
+package dlock
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Lock a held distributed lock, returned by Locker
+// every acquisition has its own Lock, safe for concurrent use
+type Lock interface {
+	// Key: lock resource name
+	Key() string
+	// Value: lock resource passed to Acquire, identify the owner
+	Value() string
+	// Token: fencing token, increase monotonically on every acquisition of key
+	Token() int64
+	// ExpireAt: expire time as of the last acquire or refresh, zero if the lock never expires
+	ExpireAt() time.Time
+
+	// Release: release the lock, return ErrNotOwner if already lost,
+	// or ErrLockExpired if lost after the expire time
+	Release(ctx context.Context) error
+	// Refresh: extend the lock to expiration from now, return ErrNotOwner or ErrLockExpired if already lost
+	// expiration must be positive, otherwise return ErrNoExpiration
+	Refresh(ctx context.Context, expiration time.Duration) error
+	// TTL: remaining time to live from backend, return ErrNotOwner or ErrLockExpired if already lost
+	TTL(ctx context.Context) (time.Duration, error)
+	// Lost: closed when the lock is released, or found lost by renewal or a backend call,
+	// a lock past ExpireAt is not closed until then, check ExpireAt if keep alive is disabled
+	Lost() <-chan struct{}
+}
+
+// holder backend operations on a held lock
+type holder interface {
+	// release return ErrNotOwner if not held
+	release(ctx context.Context) error
+	// refresh return ErrNotOwner if not held
+	refresh(ctx context.Context, expiration time.Duration) error
+	// ttl return ErrNotOwner if not held
+	ttl(ctx context.Context) (time.Duration, error)
+}
+
+// handle Lock implementation shared by backends
+type handle struct {
+	key   string
+	value string
+	token int64
+
+	holder holder
+	opts   Options
+
+	mux      *sync.Mutex
+	expireAt time.Time
+	// renew the lock if keep alive enabled
+	dog *watchdog
+
+	lost     chan struct{}
+	lostOnce sync.Once
+}
+
+// newHandle create lock handle, start renewal if keep alive enabled
+// expiration <= 0: the lock never expires, the backend must hold it so, or reject it by noExpirationErr
+func newHandle(key, value string, token int64, expiration time.Duration, h holder, opts Options) *handle {
+	return newHandleAt(key, value, token, expiration, expireTime(opts.clock().Now(), expiration), h, opts)
+}
+
+// newHandleAt create lock handle expiring at expireAt, earlier than expiration from now if the backend says so
+func newHandleAt(key, value string, token int64, expiration time.Duration, expireAt time.Time, h holder, opts Options) *handle {
+	l := &handle{
+		key:      key,
+		value:    value,
+		token:    token,
+		holder:   h,
+		opts:     opts,
+		mux:      &sync.Mutex{},
+		expireAt: expireAt,
+		lost:     make(chan struct{}),
+	}
+
+	if opts.KeepAlive {
+		// keep dog before renewal start, markLost of a failed renewal stop it
+		l.dog = newWatchdog()
+		l.dog.start(opts.KeepAliveCtx, key, expiration, opts.logger(), func(ctx context.Context) error {
+			return l.Refresh(ctx, expiration)
+		}, func(key string, err error) {
+			l.markLost()
+			if opts.OnLockLost != nil {
+				opts.OnLockLost(key, err)
+			}
+		})
+	}
+	return l
+}
+
+// Key lock resource name
+func (l *handle) Key() string {
+	return l.key
+}
+
+// Value lock resource
+func (l *handle) Value() string {
+	return l.value
+}
+
+// Token fencing token
+func (l *handle) Token() int64 {
+	return l.token
+}
+
+// ExpireAt expire time as of the last acquire or refresh, zero if no expiration
+func (l *handle) ExpireAt() time.Time {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return l.expireAt
+}
+
+// Release release the lock and stop renewal
+func (l *handle) Release(ctx context.Context) error {
+	l.dog.Stop()
+
+	err := l.holder.release(ctx)
+	if err == nil || err == ErrNotOwner {
+		l.markLost()
+	}
+	return l.wrapErr(err)
+}
+
+// Refresh extend the lock to expiration from now
+func (l *handle) Refresh(ctx context.Context, expiration time.Duration) error {
+	if expiration <= 0 {
+		return noExpirationErr(l.key, expiration)
+	}
+	expireAt := expireTime(l.opts.clock().Now(), expiration)
+	if err := l.holder.refresh(ctx, expiration); err != nil {
+		if err == ErrNotOwner {
+			l.markLost()
+		}
+		return l.wrapErr(err)
+	}
+
+	l.mux.Lock()
+	l.expireAt = expireAt
+	l.mux.Unlock()
+	return nil
+}
+
+// TTL remaining time to live from backend
+func (l *handle) TTL(ctx context.Context) (time.Duration, error) {
+	ttl, err := l.holder.ttl(ctx)
+	if err == ErrNotOwner {
+		l.markLost()
+	}
+	return ttl, l.wrapErr(err)
+}
+
+// Lost closed when the lock is released or found lost
+func (l *handle) Lost() <-chan struct{} {
+	return l.lost
+}
+
+// wrapErr error of holder operation
+// ErrNotOwner after the expire time means expired rather than taken over
+func (l *handle) wrapErr(err error) error {
+	if err == ErrNotOwner {
+		if lockExpired(l) {
+			return ErrLockExpired
+		}
+		return err
+	}
+	return backendErr(l.key, err)
+}
+
+// lockLost whether Lost of lock is closed
+func lockLost(lock Lock) bool {
+	select {
+	case <-lock.Lost():
+		return true
+	default:
+		return false
+	}
+}
+
+// expireTime expire time of expiration from now, zero if no expiration
+func expireTime(now time.Time, expiration time.Duration) time.Time {
+	if expiration <= 0 {
+		return time.Time{}
+	}
+	return now.Add(expiration)
+}
+
+// lockExpired whether lock is past its expire time, on the clock of the Locker acquired it
+func lockExpired(lock Lock) bool {
+	expireAt := lock.ExpireAt()
+	if expireAt.IsZero() {
+		return false
+	}
+	now := time.Now()
+	if h, ok := lock.(*handle); ok {
+		now = h.opts.clock().Now()
+	}
+	return !now.Before(expireAt)
+}
+
+// lockLogger logger of the Locker acquired lock
+func lockLogger(lock Lock) Logger {
+	if h, ok := lock.(*handle); ok {
+		return h.opts.logger()
+	}
+	return nopLogger{}
+}
+
+// markLost close lost channel and stop renewal
+func (l *handle) markLost() {
+	l.lostOnce.Do(func() {
+		l.dog.Stop()
+		close(l.lost)
+	})
+}
@@ -1,76 +1,300 @@
 package dlock
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"sync"
 	"time"
-
-	"github.com/go-redis/redis/v7"
 )
 
 // DLock distributed lock interface
+// key based adapter of Locker, holds at most one lock per key
 type DLock interface {
 	// Acquire:  get a lock, if success return true
-	// expiration required
+	// expiration: the lock never expires if <= 0, redis and memory only, others return ErrNoExpiration
 	// key: lock resource name , required
 	// value: lock resource, required
 	// host: which host need this lock resource, omit
 	// namespace: which app need this lock resource, omit
 	Acquire(expiration time.Duration, key, value, host string) (bool, error)
 	IsLock(key string) (bool, error)
+	// UnLock: release a lock acquired by this DLock,
+	// return ErrNotOwner if the lock is expired or held by another value
 	UnLock(key string) error
 	GetValue(key string) string
+	// GetToken: fencing token of the lock acquired by this DLock, 0 if not held or past its expire time
+	// increase monotonically on every acquisition of key, pass it to the storage to reject stale writers
+	GetToken(key string) int64
+	GetType() string
+
+	// context variants, ctx deadline and cancellation are passed to the backend
+	AcquireContext(ctx context.Context, expiration time.Duration, key, value, host string) (bool, error)
+	IsLockContext(ctx context.Context, key string) (bool, error)
+	UnLockContext(ctx context.Context, key string) error
+	GetValueContext(ctx context.Context, key string) string
+
+	// Lock: block until the lock is acquired or ctx done
+	// retry with exponential backoff on ErrLockHeld and ErrBackendUnavailable, see WithRetryOption
+	Lock(ctx context.Context, expiration time.Duration, key, value, host string) error
+
+	// AcquireMany: get the locks of all keys or none, redis, mysql and memory only
+	// every key is released by UnLock as usual
+	AcquireMany(ctx context.Context, expiration time.Duration, value, host string, keys ...string) (bool, error)
+
+	// Locker: backend of this DLock, its locks are not held by key, see WithLock
+	Locker() Locker
+
+	// Close: release connections of this DLock, locks held are not released
+	Close() error
+}
+
+// Locker distributed lock backend
+// every acquisition return its own Lock handle, so one Locker can hold many locks
+type Locker interface {
+	// Acquire: try once to get a lock, return ErrLockHeld if held by others
+	// parameters are the same as DLock.Acquire, expiration <= 0 never expires or return ErrNoExpiration
+	Acquire(ctx context.Context, expiration time.Duration, key, value, host string) (Lock, error)
+	// Lock: block until the lock is acquired or ctx done
+	Lock(ctx context.Context, expiration time.Duration, key, value, host string) (Lock, error)
+	// GetValue: value of current holder, "" if not locked
+	GetValue(ctx context.Context, key string) (string, error)
 	GetType() string
+	// Close: release connections owned by this Locker, locks held are not released
+	Close() error
 }
 
 // dlock  distributed lock
+// adapter of Locker, keep the lock handles acquired by key
 type dlock struct {
-	// MysqlLockType return id
-	// RedisLockType hash value
-	id        int64
-	namespace string
-	// may be interface
-	lockResource interface{}
-	hostIP       string
-	// timestamp
-	expireTime int64
-
-	repo *Repo
+	locker Locker
 
-	// redis cluster client
-	rc  *redis.ClusterClient
-	mux *sync.RWMutex
+	mux *sync.Mutex
+	// lock key -> locks held by this DLock, latest last
+	// more than one only if reentrant
+	held map[string][]Lock
 }
 
 const (
 	MysqlLockType = "mysql"
 	RedisLockType = "redis"
 	EtcdLockType  = "etcd"
-)
-
-var (
-	NotSupportedTypeLockErr = fmt.Errorf("not support this type distibuted lock")
+	// RedlockType redlock over independent redis masters
+	RedlockType = "redlock"
+	// MemoryLockType in-process lock, for tests and single instance deployment
+	MemoryLockType = "memory"
 )
 
 // NewDLock create distributed lock
 // options: other parameter configs
 func NewDLock(options ...func(*Options)) (DLock, error) {
+	locker, err := NewLocker(options...)
+	if err != nil {
+		return nil, err
+	}
+	return newDLock(locker), nil
+}
+
+// newDLock wrap Locker as DLock
+func newDLock(locker Locker) *dlock {
+	return &dlock{
+		locker: locker,
+		mux:    &sync.Mutex{},
+		held:   map[string][]Lock{},
+	}
+}
+
+// NewLocker create distributed lock backend of Options.Type, see RegisterBackend
+// options: other parameter configs
+// return NotSupportedTypeLockErr if the type is not registered, empty type is redis
+func NewLocker(options ...func(*Options)) (Locker, error) {
 	// init database
 	var opts Options
 	for i := range options {
 		options[i](&opts)
 	}
 
-	var dlock DLock
-	var err error
-	switch opts.Type {
-	case MysqlLockType:
-		dlock, err = NewMLock(opts)
-	case EtcdLockType:
-		dlock, err = NewELock(opts)
-	default:
-		dlock, err = NewRLock(opts)
+	factory, err := backend(opts.Type)
+	if err != nil {
+		return nil, err
+	}
+	locker, err := factory(opts)
+
+	// avoid returning non-nil interface of nil pointer
+	if err != nil {
+		return nil, err
+	}
+	return locker, nil
+}
+
+// Acquire 获取锁
+func (l *dlock) Acquire(expiration time.Duration, key, value, host string) (bool, error) {
+	return l.AcquireContext(context.Background(), expiration, key, value, host)
+}
+
+// AcquireContext 获取锁, with context
+func (l *dlock) AcquireContext(ctx context.Context, expiration time.Duration, key, value, host string) (bool, error) {
+	lock, err := l.locker.Acquire(ctx, expiration, key, value, host)
+	if errors.Is(err, ErrLockHeld) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	l.hold(lock)
+	return true, nil
+}
+
+// Lock block until the lock is acquired or ctx done
+func (l *dlock) Lock(ctx context.Context, expiration time.Duration, key, value, host string) error {
+	lock, err := l.locker.Lock(ctx, expiration, key, value, host)
+	if err != nil {
+		return err
+	}
+	l.hold(lock)
+	return nil
+}
+
+// AcquireMany get the locks of all keys or none
+func (l *dlock) AcquireMany(ctx context.Context, expiration time.Duration, value, host string, keys ...string) (bool, error) {
+	multi, ok := l.locker.(MultiLocker)
+	if !ok {
+		return false, fmt.Errorf("multi-key %s lock: %w", l.locker.GetType(), NotSupportedTypeLockErr)
+	}
+
+	locks, err := multi.AcquireMany(ctx, expiration, value, host, keys...)
+	if errors.Is(err, ErrLockHeld) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	for _, lock := range locks {
+		l.hold(lock)
+	}
+	return true, nil
+}
+
+// IsLock check if is locked already
+func (l *dlock) IsLock(key string) (bool, error) {
+	return l.IsLockContext(context.Background(), key)
+}
+
+// IsLockContext check if is locked already, with context
+func (l *dlock) IsLockContext(ctx context.Context, key string) (bool, error) {
+	value, err := l.locker.GetValue(ctx, key)
+	return len(value) > 0, err
+}
+
+// UnLock release lock
+// only the lock acquired by this DLock can be released, otherwise return ErrNotOwner
+func (l *dlock) UnLock(key string) error {
+	return l.UnLockContext(context.Background(), key)
+}
+
+// UnLockContext release lock, with context
+func (l *dlock) UnLockContext(ctx context.Context, key string) error {
+	lock := l.latest(key)
+	if lock == nil {
+		return ErrNotOwner
 	}
 
-	return dlock, err
+	err := lock.Release(ctx)
+	if err == nil || errors.Is(err, ErrNotOwner) {
+		l.drop(lock)
+	}
+	return err
+}
+
+// GetValue get lock value
+func (l *dlock) GetValue(key string) string {
+	return l.GetValueContext(context.Background(), key)
+}
+
+// GetValueContext get lock value, with context
+func (l *dlock) GetValueContext(ctx context.Context, key string) string {
+	value, _ := l.locker.GetValue(ctx, key)
+	return value
+}
+
+// GetToken fencing token of the lock held by this DLock, 0 if not held
+func (l *dlock) GetToken(key string) int64 {
+	if lock := l.latest(key); lock != nil && !lockExpired(lock) {
+		return lock.Token()
+	}
+	return 0
+}
+
+// GetType  get lock type
+func (l *dlock) GetType() string {
+	return l.locker.GetType()
+}
+
+// Locker backend of this DLock
+func (l *dlock) Locker() Locker {
+	return l.locker
+}
+
+// Close close the backend connections
+func (l *dlock) Close() error {
+	return l.locker.Close()
+}
+
+// hold keep lock handle by key, drop the lost or expired locks of all keys
+// a lock without keep alive is never marked lost on expiry, so it is dropped by its expire time
+func (l *dlock) hold(lock Lock) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	for key, held := range l.held {
+		var alive []Lock
+		for _, h := range held {
+			if !lockLost(h) && !lockExpired(h) {
+				alive = append(alive, h)
+			}
+		}
+		if len(alive) == 0 {
+			delete(l.held, key)
+		} else {
+			l.held[key] = alive
+		}
+	}
+	l.held[lock.Key()] = append(l.held[lock.Key()], lock)
+}
+
+// latest the latest lock held of key, nil if not held, the lost ones are dropped
+// the lock may be past its expire time, so that UnLock report ErrLockExpired
+func (l *dlock) latest(key string) Lock {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	held := l.held[key]
+	for len(held) > 0 && lockLost(held[len(held)-1]) {
+		held = held[:len(held)-1]
+	}
+	if len(held) == 0 {
+		delete(l.held, key)
+		return nil
+	}
+	l.held[key] = held
+	return held[len(held)-1]
+}
+
+// drop remove lock handle
+func (l *dlock) drop(lock Lock) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	held := l.held[lock.Key()]
+	for i := range held {
+		if held[i] == lock {
+			held = append(held[:i], held[i+1:]...)
+			break
+		}
+	}
+	if len(held) == 0 {
+		delete(l.held, lock.Key())
+		return
+	}
+	l.held[lock.Key()] = held
 }
@@ -1,17 +1,115 @@
 package dlock
 
 import (
+	"context"
+	"fmt"
+	"io"
 	"log"
-	"os"
+	"log/slog"
+	"strings"
 )
 
+// Level log level
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+// String level name
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	default:
+		return fmt.Sprintf("LEVEL(%d)", int(l))
+	}
+}
+
+// Logger structured logger, injected by WithLogger
+// keyvals: alternating keys and values, like log/slog
 type Logger interface {
-	Debug(v ...interface{})
-	Info(v ...interface{})
-	Warn(v ...interface{})
-	Error(v ...interface{})
+	Log(level Level, msg string, keyvals ...interface{})
+}
+
+// LoggerFunc adapter of function as Logger
+type LoggerFunc func(level Level, msg string, keyvals ...interface{})
+
+// Log call f
+func (f LoggerFunc) Log(level Level, msg string, keyvals ...interface{}) {
+	f(level, msg, keyvals...)
+}
+
+// nopLogger discard all logs, the default logger
+type nopLogger struct{}
+
+// Log discard
+func (nopLogger) Log(Level, string, ...interface{}) {}
+
+// levelLogger drop logs below min level
+type levelLogger struct {
+	logger Logger
+	min    Level
+}
+
+// Log pass to logger if level is enabled
+func (l levelLogger) Log(level Level, msg string, keyvals ...interface{}) {
+	if level >= l.min {
+		l.logger.Log(level, msg, keyvals...)
+	}
 }
 
+// NewSlogLogger adapter of *slog.Logger
+func NewSlogLogger(logger *slog.Logger) Logger {
+	return LoggerFunc(func(level Level, msg string, keyvals ...interface{}) {
+		logger.Log(context.Background(), slogLevel(level), msg, keyvals...)
+	})
+}
+
+// slogLevel slog level of level
+func slogLevel(level Level) slog.Level {
+	switch level {
+	case LevelDebug:
+		return slog.LevelDebug
+	case LevelInfo:
+		return slog.LevelInfo
+	case LevelWarn:
+		return slog.LevelWarn
+	default:
+		return slog.LevelError
+	}
+}
+
+// NewStdLogger adapter of *log.Logger, print as "LEVEL msg key=value ..."
+func NewStdLogger(logger *log.Logger) Logger {
+	return LoggerFunc(func(level Level, msg string, keyvals ...interface{}) {
+		var b strings.Builder
+		b.WriteString(level.String())
+		b.WriteString(" ")
+		b.WriteString(msg)
+		for i := 0; i < len(keyvals); i += 2 {
+			if i+1 < len(keyvals) {
+				fmt.Fprintf(&b, " %v=%v", keyvals[i], keyvals[i+1])
+			} else {
+				fmt.Fprintf(&b, " %v", keyvals[i])
+			}
+		}
+		logger.Println(b.String())
+	})
+}
+
+// DLog loggers of the package level log functions
+//
+// Deprecated: locks log to the Logger set by WithLogger, DLog loggers discard all logs.
 type DLog struct {
 	InfoL    *log.Logger
 	WarningL *log.Logger
@@ -20,54 +118,61 @@ type DLog struct {
 	DebugL   *log.Logger
 }
 
-var dlog *DLog
-
-func init() {
-	Info := log.New(os.Stdout, "Info:", log.Ldate|log.Ltime|log.Lshortfile)
-	Error := log.New(os.Stdout, "Error:", log.Ldate|log.Ltime|log.Lshortfile)
-	Debug := log.New(os.Stdout, "Debug:", log.Ldate|log.Ltime|log.Lshortfile)
-	Trace := log.New(os.Stdout, "Trace:", log.Ldate|log.Ltime|log.Lshortfile)
-	Warning := log.New(os.Stdout, "Warning:", log.Ldate|log.Ltime|log.Lshortfile)
-
-	dlog = &DLog{InfoL: Info, WarningL: Warning, ErrorL: Error, TraceL: Trace, DebugL: Debug,}
+// dlog loggers of the deprecated package level log functions, discard all logs
+var dlog = &DLog{
+	InfoL:    log.New(io.Discard, "Info:", log.LstdFlags),
+	WarningL: log.New(io.Discard, "Warning:", log.LstdFlags),
+	ErrorL:   log.New(io.Discard, "Error:", log.LstdFlags),
+	TraceL:   log.New(io.Discard, "Trace:", log.LstdFlags),
+	DebugL:   log.New(io.Discard, "Debug:", log.LstdFlags),
 }
 
+// Deprecated: use WithLogger, Debug logs nothing.
 func Debug(v ...interface{}) {
 	dlog.DebugL.Println(v...)
 }
 
+// Deprecated: use WithLogger, Debugf logs nothing.
 func Debugf(format string, v ...interface{}) {
 	dlog.DebugL.Printf(format, v...)
 }
 
+// Deprecated: use WithLogger, Info logs nothing.
 func Info(v ...interface{}) {
 	dlog.InfoL.Println(v...)
 }
 
+// Deprecated: use WithLogger, Infof logs nothing.
 func Infof(format string, v ...interface{}) {
 	dlog.InfoL.Printf(format, v...)
 }
 
+// Deprecated: use WithLogger, Warning logs nothing.
 func Warning(v ...interface{}) {
 	dlog.WarningL.Println(v...)
 }
 
+// Deprecated: use WithLogger, Warningf logs nothing.
 func Warningf(format string, v ...interface{}) {
 	dlog.WarningL.Printf(format, v...)
 }
 
+// Deprecated: use WithLogger, Trace logs nothing.
 func Trace(v ...interface{}) {
 	dlog.TraceL.Println(v...)
 }
 
+// Deprecated: use WithLogger, Tracef logs nothing.
 func Tracef(format string, v ...interface{}) {
 	dlog.TraceL.Printf(format, v...)
 }
 
+// Deprecated: use WithLogger, Error logs nothing.
 func Error(v ...interface{}) {
 	dlog.ErrorL.Println(v...)
 }
 
+// Deprecated: use WithLogger, Errorf logs nothing.
 func Errorf(format string, v ...interface{}) {
 	dlog.ErrorL.Printf(format, v...)
 }
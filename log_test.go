@@ -0,0 +1,66 @@
+package dlock
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestLogger_Adapters(t *testing.T) {
+	var buf bytes.Buffer
+	opts := Options{}
+	WithLogger(NewSlogLogger(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))), LevelWarn)(&opts)
+
+	opts.logger().Log(LevelInfo, "dropped", "key", key)
+	opts.logger().Log(LevelWarn, "renew lock fail", "key", key)
+	if out := buf.String(); strings.Contains(out, "dropped") || !strings.Contains(out, "level=WARN") || !strings.Contains(out, "key="+key) {
+		t.Fatalf("slog output: %s", out)
+	}
+
+	buf.Reset()
+	NewStdLogger(log.New(&buf, "", 0)).Log(LevelError, "lock lost", "key", key, "err")
+	if out := buf.String(); out != "ERROR lock lost key="+key+" err\n" {
+		t.Fatalf("std output: %q", out)
+	}
+
+	// silent by default
+	Options{}.logger().Log(LevelError, "discard")
+	WithLogger(nil, LevelDebug)(&opts)
+	if opts.Logger != nil {
+		t.Fatal("nil logger not reset")
+	}
+}
+
+func TestLogger_Injected(t *testing.T) {
+	mr := miniredis.RunT(t)
+	var logged []string
+	logger := LoggerFunc(func(level Level, msg string, keyvals ...interface{}) {
+		logged = append(logged, level.String()+" "+msg)
+	})
+	l := newMiniRLock(t, mr, WithLogger(logger, LevelDebug), WithRetryOption(10*time.Millisecond, 10*time.Millisecond, 0))
+
+	// contention is not logged, backend failure is
+	if _, err := l.Acquire(context.Background(), time.Minute, key, "other", host); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Lock(timeoutCtx(t, 50*time.Millisecond), time.Minute, key, value, host); err != context.DeadlineExceeded {
+		t.Fatalf("lock held, err: %v", err)
+	}
+	if len(logged) > 0 {
+		t.Fatalf("contention logged: %v", logged)
+	}
+
+	mr.Close()
+	if _, err := l.Lock(timeoutCtx(t, 50*time.Millisecond), time.Minute, key, value, host); err != context.DeadlineExceeded {
+		t.Fatalf("redis down, err: %v", err)
+	}
+	if len(logged) == 0 || logged[0] != "WARN acquire lock fail, retry later" {
+		t.Fatalf("logged: %v", logged)
+	}
+}
@@ -0,0 +1,269 @@
+package dlock
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStore in-process lock state, shared by memory Lockers on it
+// locks of different stores never contend
+type MemoryStore struct {
+	mux sync.Mutex
+	// lock key -> holder
+	locks map[string]*memEntry
+	// lock key -> fencing counter, never reset
+	tokens map[string]int64
+	// closed and replaced when any lock is released
+	released chan struct{}
+}
+
+// memEntry lock held in memory
+type memEntry struct {
+	value    string
+	token    int64
+	expireAt time.Time
+	// reentrant hold count
+	count int
+}
+
+// memLock in-process lock on a MemoryStore
+type memLock struct {
+	store *MemoryStore
+	opts  Options
+}
+
+// memHolder lock held in MemoryStore
+type memHolder struct {
+	store *MemoryStore
+	clock Clock
+	key   string
+	token int64
+}
+
+// defaultMemoryStore store of WithMemoryOption(nil), shared by the process
+var defaultMemoryStore = NewMemoryStore()
+
+// NewMemoryStore create an empty in-process lock store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		locks:    map[string]*memEntry{},
+		tokens:   map[string]int64{},
+		released: make(chan struct{}),
+	}
+}
+
+// NewMemLock create in-process distributed lock, for tests and single instance deployment
+// options: other parameter configs
+func NewMemLock(opts Options) (*memLock, error) {
+	if opts.Fair {
+		return nil, fmt.Errorf("fair %s lock: %w", MemoryLockType, NotSupportedTypeLockErr)
+	}
+	store := opts.MemoryStore
+	if store == nil {
+		store = defaultMemoryStore
+	}
+	return &memLock{store: store, opts: opts}, nil
+}
+
+// Acquire 获取锁
+// return ErrLockHeld if held by others
+// reentrant: the same value can acquire again, increase hold count
+func (l *memLock) Acquire(ctx context.Context, expiration time.Duration, key, value, host string) (Lock, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	l.store.mux.Lock()
+	defer l.store.mux.Unlock()
+
+	token, ok := l.store.acquire(l.opts.clock().Now(), expiration, key, value, l.opts.Reentrant)
+	if !ok {
+		return nil, heldErr(key)
+	}
+	return newHandle(key, value, token, expiration, &memHolder{store: l.store, clock: l.opts.clock(), key: key, token: token}, l.opts), nil
+}
+
+// AcquireMany get the locks of all keys or none
+func (l *memLock) AcquireMany(ctx context.Context, expiration time.Duration, value, host string, keys ...string) ([]Lock, error) {
+	if l.opts.Reentrant {
+		return nil, fmt.Errorf("multi-key reentrant %s lock: %w", MemoryLockType, NotSupportedTypeLockErr)
+	}
+	if err := checkKeys(keys); err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	l.store.mux.Lock()
+	defer l.store.mux.Unlock()
+
+	now := l.opts.clock().Now()
+	for _, key := range keys {
+		if l.store.held(now, key) != nil {
+			return nil, heldErr(strings.Join(keys, ","))
+		}
+	}
+	locks := make([]Lock, len(keys))
+	for i, key := range keys {
+		token, _ := l.store.acquire(now, expiration, key, value, false)
+		locks[i] = newHandle(key, value, token, expiration, &memHolder{store: l.store, clock: l.opts.clock(), key: key, token: token}, l.opts)
+	}
+	return locks, nil
+}
+
+// Lock block until the lock is acquired or ctx done
+// woken up when any lock of the store is released or the holder expires,
+// expiry is awaited on the system clock, an injected clock is checked on release only
+func (l *memLock) Lock(ctx context.Context, expiration time.Duration, key, value, host string) (Lock, error) {
+	for {
+		lock, err := l.Acquire(ctx, expiration, key, value, host)
+		if err == nil {
+			return lock, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		l.store.mux.Lock()
+		released := l.store.released
+		var expired <-chan time.Time
+		var timer *time.Timer
+		now := l.opts.clock().Now()
+		if e := l.store.held(now, key); e != nil && !e.expireAt.IsZero() {
+			timer = time.NewTimer(e.expireAt.Sub(now))
+			expired = timer.C
+		}
+		l.store.mux.Unlock()
+
+		select {
+		case <-ctx.Done():
+		case <-released:
+		case <-expired:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// GetValue get lock value, "" if not locked
+func (l *memLock) GetValue(ctx context.Context, key string) (string, error) {
+	l.store.mux.Lock()
+	defer l.store.mux.Unlock()
+	if e := l.store.held(l.opts.clock().Now(), key); e != nil {
+		return e.value, nil
+	}
+	return "", nil
+}
+
+// GetType  get lock type
+func (l *memLock) GetType() string {
+	return MemoryLockType
+}
+
+// Close nothing to release, locks held are kept in the store
+func (l *memLock) Close() error {
+	return nil
+}
+
+// held holder of key at now, drop it if expired
+// must be called with mux held
+func (s *MemoryStore) held(now time.Time, key string) *memEntry {
+	e, ok := s.locks[key]
+	if !ok {
+		return nil
+	}
+	if !e.expireAt.IsZero() && !now.Before(e.expireAt) {
+		delete(s.locks, key)
+		return nil
+	}
+	return e
+}
+
+// acquire set holder of key if not held, or held by value if reentrant
+// must be called with mux held
+func (s *MemoryStore) acquire(now time.Time, expiration time.Duration, key, value string, reentrant bool) (int64, bool) {
+	e := s.held(now, key)
+	switch {
+	case e == nil:
+		s.tokens[key]++
+		e = &memEntry{value: value, token: s.tokens[key]}
+		s.locks[key] = e
+	case reentrant && e.value == value:
+	default:
+		return 0, false
+	}
+
+	e.count++
+	e.expireAt = time.Time{}
+	if expiration > 0 {
+		e.expireAt = now.Add(expiration)
+	}
+	return e.token, true
+}
+
+// owned holder of key at now if held by token
+// must be called with mux held
+func (s *MemoryStore) owned(now time.Time, key string, token int64) *memEntry {
+	if e := s.held(now, key); e != nil && e.token == token {
+		return e
+	}
+	return nil
+}
+
+// release decrease hold count, delete key and wake up waiters when it reach 0
+func (h *memHolder) release(ctx context.Context) error {
+	s := h.store
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	e := s.owned(h.clock.Now(), h.key, h.token)
+	if e == nil {
+		return ErrNotOwner
+	}
+	if e.count--; e.count <= 0 {
+		delete(s.locks, h.key)
+		close(s.released)
+		s.released = make(chan struct{})
+	}
+	return nil
+}
+
+// refresh extend expire time of key held by token
+func (h *memHolder) refresh(ctx context.Context, expiration time.Duration) error {
+	s := h.store
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	now := h.clock.Now()
+	e := s.owned(now, h.key, h.token)
+	if e == nil {
+		return ErrNotOwner
+	}
+	e.expireAt = time.Time{}
+	if expiration > 0 {
+		e.expireAt = now.Add(expiration)
+	}
+	return nil
+}
+
+// ttl remaining ttl of key held by token, 0 if no expiration
+func (h *memHolder) ttl(ctx context.Context) (time.Duration, error) {
+	s := h.store
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	now := h.clock.Now()
+	e := s.owned(now, h.key, h.token)
+	if e == nil {
+		return 0, ErrNotOwner
+	}
+	if e.expireAt.IsZero() {
+		return 0, nil
+	}
+	return e.expireAt.Sub(now), nil
+}
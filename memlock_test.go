@@ -0,0 +1,227 @@
+package dlock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newMemDLock create DLock on store
+func newMemDLock(t *testing.T, store *MemoryStore, options ...func(*Options)) DLock {
+	l, err := NewDLock(append([]func(*Options){WithMemoryOption(store)}, options...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+func TestMemLock_Acquire(t *testing.T) {
+	store := NewMemoryStore()
+	l, other := newMemDLock(t, store), newMemDLock(t, store)
+
+	if l.GetType() != MemoryLockType {
+		t.Fatalf("type: %s", l.GetType())
+	}
+	success, err := l.Acquire(time.Minute, key, value, host)
+	if err != nil || !success {
+		t.Fatalf("acquire fail, success: %t, err: %v", success, err)
+	}
+	if got := other.GetValue(key); got != value {
+		t.Fatalf("lock value: %s, want: %s", got, value)
+	}
+	if success, err = other.Acquire(time.Minute, key, "other", host); err != nil || success {
+		t.Fatalf("acquire held lock, success: %t, err: %v", success, err)
+	}
+	if err = other.UnLock(key); err != ErrNotOwner {
+		t.Fatalf("unlock by other, err: %v", err)
+	}
+
+	// stores never contend
+	if success, err = newMemDLock(t, NewMemoryStore()).Acquire(time.Minute, key, "other", host); err != nil || !success {
+		t.Fatalf("acquire in other store, success: %t, err: %v", success, err)
+	}
+
+	if err = l.UnLock(key); err != nil {
+		t.Fatal(err)
+	}
+	if locked, _ := other.IsLock(key); locked {
+		t.Fatal("lock not released by owner")
+	}
+}
+
+func TestMemLock_Expire(t *testing.T) {
+	store, clock := NewMemoryStore(), newFakeClock()
+	l, other := newMemDLock(t, store, WithClock(clock)), newMemDLock(t, store, WithClock(clock))
+
+	if success, err := l.Acquire(time.Minute, key, value, host); err != nil || !success {
+		t.Fatalf("acquire fail, success: %t, err: %v", success, err)
+	}
+	token := l.GetToken(key)
+	clock.Add(59 * time.Second)
+	if success, _ := other.Acquire(time.Minute, key, "other", host); success {
+		t.Fatal("acquire lock before expiry")
+	}
+	clock.Add(time.Second)
+
+	success, err := other.Acquire(time.Minute, key, "other", host)
+	if err != nil || !success {
+		t.Fatalf("acquire expired lock, success: %t, err: %v", success, err)
+	}
+	if other.GetToken(key) <= token {
+		t.Fatalf("token not increased, %d <= %d", other.GetToken(key), token)
+	}
+	if err = l.UnLock(key); !errors.Is(err, ErrLockExpired) {
+		t.Fatalf("unlock expired lock, err: %v", err)
+	}
+	if got := other.GetValue(key); got != "other" {
+		t.Fatalf("lock value: %s, want: other", got)
+	}
+}
+
+func TestMemLock_NoExpiration(t *testing.T) {
+	store, clock := NewMemoryStore(), newFakeClock()
+	l := newMemDLock(t, store, WithClock(clock))
+
+	// kept by DLock without expiration
+	if success, err := l.Acquire(0, key, value, host); err != nil || !success {
+		t.Fatalf("acquire fail, success: %t, err: %v", success, err)
+	}
+	clock.Add(time.Hour)
+	if success, err := l.Acquire(0, "other", value, host); err != nil || !success {
+		t.Fatalf("acquire fail, success: %t, err: %v", success, err)
+	}
+	if token := l.GetToken(key); token <= 0 {
+		t.Fatalf("token of lock without expiration: %d", token)
+	}
+	if err := l.UnLock(key); err != nil {
+		t.Fatal(err)
+	}
+
+	// refresh must set an expiration
+	lock, err := l.Locker().Acquire(context.Background(), time.Minute, key, value, host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = lock.Refresh(context.Background(), 0); !errors.Is(err, ErrNoExpiration) {
+		t.Fatalf("refresh without expiration, err: %v", err)
+	}
+}
+
+func TestMemLock_Lock(t *testing.T) {
+	store := NewMemoryStore()
+	l, other := newMemDLock(t, store), newMemDLock(t, store)
+
+	if success, err := l.Acquire(time.Minute, key, value, host); err != nil || !success {
+		t.Fatalf("acquire fail, success: %t, err: %v", success, err)
+	}
+	if err := other.Lock(timeoutCtx(t, 50*time.Millisecond), time.Minute, key, "other", host); err != context.DeadlineExceeded {
+		t.Fatalf("lock held key, err: %v", err)
+	}
+
+	// woken up by release
+	time.AfterFunc(50*time.Millisecond, func() {
+		if err := l.UnLock(key); err != nil {
+			t.Error(err)
+		}
+	})
+	if err := other.Lock(timeoutCtx(t, time.Second), 100*time.Millisecond, key, "other", host); err != nil {
+		t.Fatal(err)
+	}
+
+	// woken up by expiry
+	start := time.Now()
+	if err := l.Lock(timeoutCtx(t, time.Second), time.Minute, key, value, host); err != nil {
+		t.Fatal(err)
+	}
+	if waited := time.Since(start); waited < 50*time.Millisecond {
+		t.Fatalf("acquired before expiry, waited: %s", waited)
+	}
+}
+
+func TestMemLock_Reentrant(t *testing.T) {
+	store := NewMemoryStore()
+	l := newMemDLock(t, store, WithReentrant())
+	other := newMemDLock(t, store, WithReentrant())
+
+	for i := 0; i < 2; i++ {
+		if success, err := l.Acquire(time.Minute, key, value, host); err != nil || !success {
+			t.Fatalf("acquire %d fail, success: %t, err: %v", i, success, err)
+		}
+	}
+	if success, _ := other.Acquire(time.Minute, key, "other", host); success {
+		t.Fatal("reentrant lock acquired by other value")
+	}
+
+	if err := l.UnLock(key); err != nil {
+		t.Fatal(err)
+	}
+	if locked, _ := other.IsLock(key); !locked {
+		t.Fatal("released before hold count reach 0")
+	}
+	if err := l.UnLock(key); err != nil {
+		t.Fatal(err)
+	}
+	if locked, _ := other.IsLock(key); locked {
+		t.Fatal("not released when hold count reach 0")
+	}
+}
+
+func TestMemLock_AcquireMany(t *testing.T) {
+	store := NewMemoryStore()
+	l, other := newMemDLock(t, store), newMemDLock(t, store)
+	ctx := context.Background()
+
+	success, err := l.AcquireMany(ctx, time.Minute, value, host, "src", "dst")
+	if err != nil || !success {
+		t.Fatalf("acquire many, success: %t, err: %v", success, err)
+	}
+	success, err = other.AcquireMany(ctx, time.Minute, "other", host, "dst", "backup")
+	if err != nil || success {
+		t.Fatalf("acquire many with held key, success: %t, err: %v", success, err)
+	}
+	if locked, _ := other.IsLock("backup"); locked {
+		t.Fatal("partial hold of free key")
+	}
+
+	if _, err = NewDLock(WithMemoryOption(store), WithFair()); !errors.Is(err, NotSupportedTypeLockErr) {
+		t.Fatalf("fair memory lock, err: %v", err)
+	}
+}
+
+func TestMemLock_Concurrent(t *testing.T) {
+	store := NewMemoryStore()
+
+	// critical section entered by one holder at a time
+	var inside, entered int32
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			l := newMemDLock(t, store)
+			v := fmt.Sprintf("value_%d", i)
+			if err := l.Lock(timeoutCtx(t, 5*time.Second), time.Minute, key, v, host); err != nil {
+				t.Error(err)
+				return
+			}
+			if n := atomic.AddInt32(&inside, 1); n != 1 {
+				t.Errorf("%d holders inside", n)
+			}
+			atomic.AddInt32(&entered, 1)
+			time.Sleep(time.Millisecond)
+			atomic.AddInt32(&inside, -1)
+			if err := l.UnLock(key); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if entered != 10 {
+		t.Fatalf("entered by %d holders", entered)
+	}
+}
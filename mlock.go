@@ -1,78 +1,140 @@
 package dlock
 
 import (
+	"context"
 	"fmt"
-	"sync"
 	"time"
 )
 
 // mLock  distributed lock
 type mLock struct {
-	id         int64
-	namespace  string
-	key        string
-	host       string
-	expireTime time.Duration
-	repo       *Repo
-	mux        *sync.RWMutex
+	repo *Repo
+	opts Options
+}
+
+// mysqlHolder lock held by row of dlock table
+type mysqlHolder struct {
+	repo  *Repo
+	token int64
+	key   string
+	value string
+	// release decrease hold_count of row
+	reentrant bool
 }
 
 // NewMLock create mysql distributed lock
 // options: other parameter configs
 func NewMLock(opts Options) (*mLock, error) {
-	// require check
-	if err := NewValidate().
-		StringIsNull(opts.User, "database user").
-		StringIsNull(opts.IP, "database host ip").
-		StringIsNull(opts.Password, "database password").
-		StringIsNull(opts.Name, "database value").ToError();
-		err != nil {
-		return nil, err
+	if opts.Fair && opts.Reentrant {
+		return nil, fmt.Errorf("fair reentrant %s lock: %w", MysqlLockType, NotSupportedTypeLockErr)
 	}
 
-	r, err := initRepo(opts.User, opts.Password, opts.Name, opts.IP, opts.Port)
+	var r *Repo
+	var err error
+	if opts.DB != nil {
+		// caller-supplied db, reused as it is
+		r, err = newRepo(opts.DB, opts.logger(), opts.clock())
+	} else {
+		// require check
+		if err := NewValidate().
+			StringIsNull(opts.User, "database user").
+			StringIsNull(opts.IP, "database host ip").
+			StringIsNull(opts.Password, "database password").
+			StringIsNull(opts.Name, "database value").ToError();
+			err != nil {
+			return nil, err
+		}
+		r, err = initRepo(opts.User, opts.Password, opts.Name, opts.IP, opts.Port, opts.logger(), opts.clock())
+	}
 	if err != nil {
-		return nil, fmt.Errorf("init repo fail, err: %v", err)
+		return nil, fmt.Errorf("init repo fail, err: %w", err)
 	}
 
 	if r == nil {
 		return nil, fmt.Errorf("init repo fail")
 	}
 
+	// expiry of rows and handles decided by server clock
+	if opts.DBClock {
+		clock, err := newDBClock(context.Background(), r.db, opts.logger())
+		if err != nil {
+			_ = r.Close()
+			return nil, fmt.Errorf("sync mysql server clock fail, err: %w", unavailableErr(err))
+		}
+		r.clock = clock
+		r.serverClock = true
+		opts.Clock = clock
+	}
+
 	return &mLock{
 		repo: r,
-		mux:  &sync.RWMutex{},
+		opts: opts,
 	}, nil
 }
 
 // Acquire 获取锁
-func (l *mLock) Acquire(expiredTime time.Duration, key, value, host string) (bool, error) {
-	id, err := l.repo.insertLockRes(&LockTable{Name: key, LockResource: value, ExpiredTime: time.Now().Add(expiredTime).Unix(), Host: host})
-	if id > 0 {
-		l.addLockID(id)
+// return ErrLockHeld if held by others
+// fencing token is id + fencing of the row, increase on every takeover of the row
+// reentrant: the same value can acquire again, increase hold_count of the row
+// fair: acquire only if no waiter is queued
+// return ErrNoExpiration if expiredTime <= 0, a row never expires is never taken over
+func (l *mLock) Acquire(ctx context.Context, expiredTime time.Duration, key, value, host string) (Lock, error) {
+	if expiredTime <= 0 {
+		return nil, noExpirationErr(key, expiredTime)
+	}
+	if l.opts.Fair {
+		return l.tryFair(ctx, expiredTime, 0, key, value, host, holderID())
+	}
+	tab := &LockTable{Name: key, LockResource: value, Expiration: expiredTime, Host: host}
+
+	var token int64
+	var err error
+	if l.opts.Reentrant {
+		token, err = l.repo.reentrantLockRes(ctx, tab)
+	} else {
+		token, err = l.repo.insertLockRes(ctx, tab)
 	}
-	return id > 0 && err == nil, err
+	if err != nil {
+		return nil, backendErr(key, err)
+	}
+	if token <= 0 {
+		return nil, heldErr(key)
+	}
+
+	h := &mysqlHolder{repo: l.repo, token: token, key: key, value: value, reentrant: l.opts.Reentrant}
+	return newHandle(key, value, token, expiredTime, h, l.opts), nil
 }
 
-// IsLock check if is locked already
-func (l *mLock) IsLock(key string) (bool, error) {
-	tab, err := l.repo.queryLockRes(&LockTable{LockResource: key})
-	return err == nil && tab != nil && tab.ID > 0, err
+// Lock block until the lock is acquired or ctx done
+// fair: wait in the queue of key, see WithFair
+func (l *mLock) Lock(ctx context.Context, expiredTime time.Duration, key, value, host string) (Lock, error) {
+	if expiredTime <= 0 {
+		return nil, noExpirationErr(key, expiredTime)
+	}
+	if l.opts.Fair {
+		return waitFair(ctx, l.opts, l, expiredTime, key, value, host)
+	}
+	return waitLock(ctx, l.opts, key, func(ctx context.Context) (Lock, error) {
+		return l.Acquire(ctx, expiredTime, key, value, host)
+	})
 }
 
-// UnLock release lock
-func (l *mLock) UnLock(key string) error {
-	_, err := l.repo.deleteLockKey(key)
-	return err
+// GetValue get lock value, "" if not locked
+func (l *mLock) GetValue(ctx context.Context, key string) (string, error) {
+	lock, err := l.repo.queryLockRes(ctx, &LockTable{Name: key})
+	if err != nil || lock == nil {
+		return "", backendErr(key, err)
+	}
+	return lock.LockResource, nil
 }
 
-// GetLockID get  lock id
-func (l *mLock) GetValue(key string) (value string) {
-	lock, _ := l.repo.queryLockRes(&LockTable{Name: key})
-	if lock != nil {
-		return lock.LockResource
+// getHolder value and host of the lock row, "" if not locked
+func (l *mLock) getHolder(ctx context.Context, key string) (value, host string, err error) {
+	lock, err := l.repo.queryLockRes(ctx, &LockTable{Name: key})
+	if err != nil || lock == nil {
+		return "", "", backendErr(key, err)
 	}
-	return ""
+	return lock.LockResource, lock.Host, nil
 }
 
 // GetType  get lock type
@@ -80,9 +142,50 @@ func (l *mLock) GetType() string {
 	return MysqlLockType
 }
 
-// addLockID 写入lock id
-func (l *mLock) addLockID(id int64) {
-	l.mux.Lock()
-	l.id = id
-	l.mux.Unlock()
+// Close close database connection pool, locks held are not released
+func (l *mLock) Close() error {
+	return l.repo.Close()
+}
+
+// release soft delete the row only if lock_resource matches
+// reentrant: decrease hold_count, soft delete the row when it reach 0
+func (h *mysqlHolder) release(ctx context.Context) error {
+	var affected int64
+	var err error
+	if h.reentrant {
+		affected, err = h.repo.releaseReentrantLockKey(ctx, h.key, h.value)
+	} else {
+		affected, err = h.repo.deleteLockKey(ctx, h.key, h.value)
+	}
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrNotOwner
+	}
+	return nil
+}
+
+// refresh extend expire_at of the lock held by value
+func (h *mysqlHolder) refresh(ctx context.Context, expiredTime time.Duration) error {
+	affected, err := h.repo.renewLockKey(ctx, h.key, h.value, expiredTime)
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrNotOwner
+	}
+	return nil
+}
+
+// ttl remaining ttl of the row
+func (h *mysqlHolder) ttl(ctx context.Context) (time.Duration, error) {
+	lock, err := h.repo.queryLockRes(ctx, &LockTable{Name: h.key})
+	if err != nil {
+		return 0, err
+	}
+	if lock == nil || lock.token() != h.token {
+		return 0, ErrNotOwner
+	}
+	return time.Unix(lock.ExpiredTime, 0).Sub(h.repo.clock.Now()), nil
 }
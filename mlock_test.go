@@ -1,8 +1,12 @@
 package dlock
 
 import (
+	"context"
+	"errors"
 	"testing"
 	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
 )
 
 const (
@@ -11,42 +15,167 @@ const (
 	host  = "10.0.3.57"
 )
 
+// newMockMLock create mysql DLock on sqlmock db with dlock table
+func newMockMLock(t *testing.T, options ...func(*Options)) (DLock, sqlmock.Sqlmock) {
+	r, mock := newMockRepo(t)
+	var opts Options
+	for i := range options {
+		options[i](&opts)
+	}
+	r.clock = opts.clock()
+	return newDLock(&mLock{repo: r, opts: opts}), mock
+}
+
 func TestMLock_Acquire(t *testing.T) {
-	l, err := NewDLock(
-		WithDBOption(user, password, ip, database, port))
+	l, mock := newMockMLock(t)
 
-	if err != nil {
-		t.Error(err)
-		return
+	mock.ExpectExec(acquireSql).WithArgs(acquireArgs(key, value, host, sqlmock.AnyArg(), sqlmock.AnyArg())...).WillReturnResult(sqlmock.NewResult(9, 1))
+	success, err := l.Acquire(5*time.Minute, key, value, host)
+	if err != nil || !success {
+		t.Fatalf("acquire fail, success: %t, err: %v", success, err)
+	}
+	if token := l.GetToken(key); token != 9 {
+		t.Fatalf("token: %d, want: 9", token)
 	}
 
-	success, err := l.Acquire(5*time.Minute, key, value, host)
-	if err != nil {
-		t.Error(err)
-		return
+	mock.ExpectExec(acquireSql).WithArgs(acquireArgs(key, "other", host, sqlmock.AnyArg(), sqlmock.AnyArg())...).WillReturnResult(sqlmock.NewResult(0, 0))
+	if success, err = l.Acquire(5*time.Minute, key, "other", host); err != nil || success {
+		t.Fatalf("acquire held lock, success: %t, err: %v", success, err)
+	}
+
+	mock.ExpectQuery(querySql).WithArgs(key, sqlmock.AnyArg()).WillReturnRows(lockRows(&LockTable{ID: 9, Name: key, LockResource: value}))
+	if got := l.GetValue(key); got != value {
+		t.Fatalf("lock value: %s, want: %s", got, value)
 	}
-	t.Logf("lock status : %t, value:%s", success, l.GetValue(value))
 }
 
 func TestMLock_Release(t *testing.T) {
-	l, err := NewDLock(
-		WithDBOption(user, password, ip, database, port))
+	l, mock := newMockMLock(t)
 
+	mock.ExpectExec(acquireSql).WithArgs(acquireArgs(key, value, host, sqlmock.AnyArg(), sqlmock.AnyArg())...).WillReturnResult(sqlmock.NewResult(9, 1))
+	if success, err := l.Acquire(5*time.Minute, key, value, host); err != nil || !success {
+		t.Fatalf("acquire fail, success: %t, err: %v", success, err)
+	}
+
+	mock.ExpectExec(releaseSql).WithArgs(sqlmock.AnyArg(), key, value, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+	if err := l.UnLock(key); err != nil {
+		t.Fatal(err)
+	}
+
+	// released already
+	if err := l.UnLock(key); err != ErrNotOwner {
+		t.Fatalf("unlock released lock, err: %v", err)
+	}
+}
+
+func TestMLock_ReleaseExpired(t *testing.T) {
+	clock := newFakeClock()
+	l, mock := newMockMLock(t, WithClock(clock))
+	now := clock.Now()
+
+	mock.ExpectExec(acquireSql).WithArgs(acquireArgs(key, value, host, int64(60), now.Unix())...).WillReturnResult(sqlmock.NewResult(9, 1))
+	if success, err := l.Acquire(time.Minute, key, value, host); err != nil || !success {
+		t.Fatalf("acquire fail, success: %t, err: %v", success, err)
+	}
+	clock.Add(time.Minute)
+
+	// no token of expired lock without keep alive, row expired, nothing released
+	if token := l.GetToken(key); token != 0 {
+		t.Fatalf("token of expired lock: %d", token)
+	}
+	mock.ExpectExec(releaseSql).WithArgs(sqlmock.AnyArg(), key, value, now.Add(time.Minute).Unix()).WillReturnResult(sqlmock.NewResult(0, 0))
+	if err := l.UnLock(key); !errors.Is(err, ErrLockExpired) {
+		t.Fatalf("unlock expired lock, err: %v", err)
+	}
+}
+
+func TestMLock_WithSQLDB(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
 	if err != nil {
-		t.Error(err)
-		return
+		t.Fatal(err)
 	}
+	defer db.Close()
 
-	success, err := l.Acquire(5*time.Minute, key, value, host)
+	expectTable(mock)
+	l, err := NewDLock(WithSQLDB(db))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.GetType() != MysqlLockType {
+		t.Fatalf("type: %s", l.GetType())
+	}
+
+	// caller-supplied db is left open
+	if err = l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Ping(); err != nil {
+		t.Fatalf("db after close, err: %v", err)
+	}
+}
+
+func TestMLock_DropExpired(t *testing.T) {
+	clock := newFakeClock()
+	l, mock := newMockMLock(t, WithClock(clock))
+
+	mock.ExpectExec(acquireSql).WithArgs(acquireArgs(key, value, host, int64(60), sqlmock.AnyArg())...).WillReturnResult(sqlmock.NewResult(9, 1))
+	if success, err := l.Acquire(time.Minute, key, value, host); err != nil || !success {
+		t.Fatalf("acquire fail, success: %t, err: %v", success, err)
+	}
+	clock.Add(time.Minute)
+
+	// expired handle of key dropped by the next acquisition of any key
+	mock.ExpectExec(acquireSql).WithArgs(acquireArgs("other", value, host, int64(60), sqlmock.AnyArg())...).WillReturnResult(sqlmock.NewResult(10, 1))
+	if success, err := l.Acquire(time.Minute, "other", value, host); err != nil || !success {
+		t.Fatalf("acquire fail, success: %t, err: %v", success, err)
+	}
+	if held := l.(*dlock).held; len(held) != 1 || len(held["other"]) != 1 {
+		t.Fatalf("locks held: %v", held)
+	}
+}
+
+func TestMLock_KeepAlive(t *testing.T) {
+	r, mock := newMockRepo(t)
+	l := &mLock{repo: r, opts: Options{KeepAlive: true}}
+	anyArg := sqlmock.AnyArg()
+
+	// renewed every 500ms to the expiration in seconds
+	// expected before acquire, the watchdog may renew as soon as the lock is held
+	mock.ExpectExec(acquireSql).WithArgs(acquireArgs(key, value, host, int64(2), anyArg)...).WillReturnResult(sqlmock.NewResult(9, 1))
+	mock.ExpectExec(renewSql).WithArgs(int64(2), anyArg, key, value, anyArg).WillReturnResult(sqlmock.NewResult(0, 1))
+	lock, err := l.Acquire(context.Background(), 1500*time.Millisecond, key, value, host)
 	if err != nil {
-		t.Error(err)
-		return
-	}
-	if success {
-		time.Sleep(30 * time.Second)
-		if err = l.UnLock(value); err != nil {
-			t.Error(err)
-			return
-		}
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for mock.ExpectationsWereMet() != nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("lock not renewed, err: %v", err)
+	}
+
+	mock.ExpectExec(releaseSql).WithArgs(anyArg, key, value, anyArg).WillReturnResult(sqlmock.NewResult(0, 1))
+	if err = lock.Release(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMLock_NoExpiration(t *testing.T) {
+	l, mock := newMockMLock(t)
+
+	// a row without expiration would be taken over at once, rejected without query
+	if _, err := l.Acquire(0, key, value, host); !errors.Is(err, ErrNoExpiration) || !errors.Is(err, NotSupportedTypeLockErr) {
+		t.Fatalf("acquire without expiration, err: %v", err)
+	}
+	if err := l.Lock(context.Background(), 0, key, value, host); !errors.Is(err, ErrNoExpiration) {
+		t.Fatalf("lock without expiration, err: %v", err)
+	}
+	if _, err := l.AcquireMany(context.Background(), 0, value, host, key, "other"); !errors.Is(err, ErrNoExpiration) {
+		t.Fatalf("acquire many without expiration, err: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
 	}
 }
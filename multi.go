@@ -0,0 +1,158 @@
+package dlock
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+)
+
+// MultiLocker lock a set of keys together, all or nothing
+// implemented by redis, mysql and memory Locker
+type MultiLocker interface {
+	// AcquireMany: try once to get the locks of all keys, one Lock per key in order of keys
+	// return ErrLockHeld if any key is held by others, and none is held then
+	AcquireMany(ctx context.Context, expiration time.Duration, value, host string, keys ...string) ([]Lock, error)
+}
+
+// multiAcquireScript set all keys if none exists, and increase their fencing counters
+// KEYS[1..n]: lock keys, KEYS[n+1..2n]: fencing keys, ARGV[1]: value, ARGV[2]: expiration ms
+// return fencing tokens in order of keys, empty if any key exists
+var multiAcquireScript = redis.NewScript(fencingPrelude + `
+local n = #KEYS / 2
+for i = 1, n do
+	if redis.call("exists", KEYS[i]) == 1 then
+		return {}
+	end
+end
+local tokens = {}
+for i = 1, n do
+	if tonumber(ARGV[2]) > 0 then
+		redis.call("set", KEYS[i], ARGV[1], "PX", ARGV[2])
+	else
+		redis.call("set", KEYS[i], ARGV[1])
+	end
+	tokens[i] = nextToken(KEYS[n + i])
+end
+return tokens
+`)
+
+// AcquireMany set all keys in one lua script
+// redis cluster: all keys must share one hash tag, so they are in the same slot
+func (l *rLock) AcquireMany(ctx context.Context, expiration time.Duration, value, host string, keys ...string) ([]Lock, error) {
+	if l.opts.Reentrant || l.opts.Fair {
+		return nil, fmt.Errorf("multi-key reentrant or fair %s lock: %w", RedisLockType, NotSupportedTypeLockErr)
+	}
+	if err := checkKeys(keys); err != nil {
+		return nil, err
+	}
+	if _, ok := l.rc.(*redis.ClusterClient); ok {
+		if err := checkHashTag(keys); err != nil {
+			return nil, err
+		}
+	}
+
+	scriptKeys := make([]string, 0, 2*len(keys))
+	scriptKeys = append(scriptKeys, keys...)
+	for _, key := range keys {
+		scriptKeys = append(scriptKeys, fencingKey(key))
+	}
+	tokens, err := multiAcquireScript.Run(withContext(ctx, l.rc), scriptKeys, value, expiration.Milliseconds()).Result()
+	if err != nil {
+		return nil, backendErr(strings.Join(keys, ","), err)
+	}
+
+	results, _ := tokens.([]interface{})
+	if len(results) != len(keys) {
+		return nil, heldErr(strings.Join(keys, ","))
+	}
+	locks := make([]Lock, len(keys))
+	for i, key := range keys {
+		token, _ := results[i].(int64)
+		locks[i] = newHandle(key, value, token, expiration, &redisHolder{rc: l.rc, scripts: plainScripts, key: key, value: value}, l.opts)
+	}
+	return locks, nil
+}
+
+// AcquireMany insert rows of all keys in one transaction
+func (l *mLock) AcquireMany(ctx context.Context, expiredTime time.Duration, value, host string, keys ...string) ([]Lock, error) {
+	if l.opts.Reentrant || l.opts.Fair {
+		return nil, fmt.Errorf("multi-key reentrant or fair %s lock: %w", MysqlLockType, NotSupportedTypeLockErr)
+	}
+	if err := checkKeys(keys); err != nil {
+		return nil, err
+	}
+	if expiredTime <= 0 {
+		return nil, noExpirationErr(strings.Join(keys, ","), expiredTime)
+	}
+
+	tabs := make([]*LockTable, len(keys))
+	for i, key := range keys {
+		tabs[i] = &LockTable{Name: key, LockResource: value, Expiration: expiredTime, Host: host}
+	}
+	ids, err := l.repo.multiLockRes(ctx, tabs)
+	if err != nil {
+		return nil, backendErr(strings.Join(keys, ","), err)
+	}
+	if ids == nil {
+		return nil, heldErr(strings.Join(keys, ","))
+	}
+
+	locks := make([]Lock, len(keys))
+	for i, key := range keys {
+		locks[i] = newHandle(key, value, ids[i], expiredTime, &mysqlHolder{repo: l.repo, token: ids[i], key: key, value: value}, l.opts)
+	}
+	return locks, nil
+}
+
+// checkKeys keys must be non-empty and distinct
+func checkKeys(keys []string) error {
+	if len(keys) == 0 {
+		return fmt.Errorf("no key to lock")
+	}
+	seen := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		if len(key) == 0 {
+			return fmt.Errorf("empty key to lock")
+		}
+		if seen[key] {
+			return fmt.Errorf("duplicate key %s to lock", key)
+		}
+		seen[key] = true
+	}
+	return nil
+}
+
+// checkHashTag keys must share one hash tag in redis cluster
+func checkHashTag(keys []string) error {
+	if len(keys) == 1 {
+		return nil
+	}
+	tag := hashTag(keys[0])
+	for _, key := range keys {
+		if len(tag) == 0 || hashTag(key) != tag {
+			return fmt.Errorf("keys %s must share one hash tag in redis cluster", strings.Join(keys, ","))
+		}
+	}
+	return nil
+}
+
+// hashTag content of the first {...} in key, "" if none
+func hashTag(key string) string {
+	if start := strings.Index(key, "{"); start >= 0 {
+		if end := strings.Index(key[start+1:], "}"); end > 0 {
+			return key[start+1 : start+1+end]
+		}
+	}
+	return ""
+}
+
+// sortedTables tables in order of name, lock rows in the same order to avoid deadlock
+func sortedTables(tabs []*LockTable) []*LockTable {
+	sorted := append([]*LockTable(nil), tabs...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+	return sorted
+}
@@ -0,0 +1,72 @@
+package dlock
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestMultiLock_Redis(t *testing.T) {
+	mr := miniredis.RunT(t)
+	l, other := newMiniDLock(t, mr), newMiniDLock(t, mr)
+	ctx := context.Background()
+
+	success, err := l.AcquireMany(ctx, time.Minute, value, host, "src", "dst")
+	if err != nil || !success {
+		t.Fatalf("acquire many, success: %t, err: %v", success, err)
+	}
+	if l.GetToken("src") <= 0 || l.GetToken("dst") <= 0 {
+		t.Fatalf("tokens: %d, %d", l.GetToken("src"), l.GetToken("dst"))
+	}
+
+	// one key held, none acquired
+	success, err = other.AcquireMany(ctx, time.Minute, "other", host, "dst", "backup")
+	if err != nil || success {
+		t.Fatalf("acquire many with held key, success: %t, err: %v", success, err)
+	}
+	if mr.Exists("backup") {
+		t.Fatal("partial hold of free key")
+	}
+
+	for _, key := range []string{"src", "dst"} {
+		if err = l.UnLock(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	success, err = other.AcquireMany(ctx, time.Minute, "other", host, "dst", "backup")
+	if err != nil || !success {
+		t.Fatalf("acquire many after unlock, success: %t, err: %v", success, err)
+	}
+
+	if _, err = l.AcquireMany(ctx, time.Minute, value, host, "src", "src"); err == nil {
+		t.Fatal("duplicate keys accepted")
+	}
+	if _, err = l.AcquireMany(ctx, time.Minute, value, host); err == nil {
+		t.Fatal("no key accepted")
+	}
+	fair := newDLock(newMiniRLock(t, mr, WithFair()))
+	if _, err = fair.AcquireMany(ctx, time.Minute, value, host, "a", "b"); !errors.Is(err, NotSupportedTypeLockErr) {
+		t.Fatalf("fair multi-key lock, err: %v", err)
+	}
+}
+
+func TestCheckHashTag(t *testing.T) {
+	cases := []struct {
+		keys []string
+		ok   bool
+	}{
+		{[]string{"a"}, true},
+		{[]string{"{host}:src", "{host}:dst"}, true},
+		{[]string{"{host}:src", "{other}:dst"}, false},
+		{[]string{"src", "dst"}, false},
+		{[]string{"{}:src", "{}:dst"}, false},
+	}
+	for _, c := range cases {
+		if err := checkHashTag(c.keys); (err == nil) != c.ok {
+			t.Errorf("keys %v, err: %v", c.keys, err)
+		}
+	}
+}
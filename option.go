@@ -1,10 +1,14 @@
 package dlock
 
-import "time"
+import (
+	"context"
+	"database/sql"
+	"time"
+)
 
 // Options external option
 type Options struct {
-	// lock type: mysql/redis/etcd/zk
+	// lock type: mysql/redis/etcd/redlock/memory, or one registered by RegisterBackend
 	Type string
 
 	// common option
@@ -31,6 +35,44 @@ type Options struct {
 	CAFile string
 	// skip https
 	SkipSSL bool
+
+	// keep alive option
+	// renew held lock in background until UnLock or KeepAliveCtx done
+	// the lock is taken as lost once KeepAliveCtx is done, as it is not renewed any more
+	KeepAlive    bool
+	KeepAliveCtx context.Context
+	// called when renewal fail and the lock is lost, or with the ctx error when KeepAliveCtx done
+	OnLockLost func(key string, err error)
+
+	// blocking Lock retry option
+	// first wait interval, doubled after every try until MaxRetryInterval
+	RetryInterval    time.Duration
+	MaxRetryInterval time.Duration
+	// random ratio added to every wait interval, 0 ~ 1
+	RetryJitter float64
+
+	// reentrant lock, the same value can acquire a held lock again,
+	// and must release the same times, redis and mysql only
+	Reentrant bool
+
+	// fair lock, blocking Lock waiters are queued and served in arrival order,
+	// a waiter leaves the queue when its ctx is done or it stops polling
+	Fair bool
+
+	// caller-supplied clients, reused instead of creating new ones, not closed by Close
+	RedisClient Clienter
+	DB          *sql.DB
+
+	// memory lock option, store shared by the process if nil
+	MemoryStore *MemoryStore
+
+	// Logger log of background renewal, retry and backend connection, silent if nil
+	Logger Logger
+
+	// Clock current time for expiry computation, the local clock if nil
+	Clock Clock
+	// DBClock mysql lock decides expiry by the clock of database server, see WithDBClock
+	DBClock bool
 }
 
 const (
@@ -66,6 +108,44 @@ func WithRedisOption(password string, DialTimeout time.Duration, cluster ...stri
 	}
 }
 
+// WithRedisClient reuse a configured redis client, *redis.Client or *redis.ClusterClient
+// the client is not closed by Close of lock
+func WithRedisClient(client Clienter) func(*Options) {
+	return func(opts *Options) {
+		opts.RedisClient = client
+		opts.Type = RedisLockType
+	}
+}
+
+// WithSQLDB reuse a configured mysql connection pool, dlock table is created if not exists
+// the db is not closed by Close of lock
+func WithSQLDB(db *sql.DB) func(*Options) {
+	return func(opts *Options) {
+		opts.DB = db
+		opts.Type = MysqlLockType
+	}
+}
+
+// WithMemoryOption setting in-process lock options
+// store: lockers on the same store contend, nil to use the store shared by the process
+func WithMemoryOption(store *MemoryStore) func(*Options) {
+	return func(opts *Options) {
+		opts.MemoryStore = store
+		opts.Type = MemoryLockType
+	}
+}
+
+// WithRedlockOption setting redlock options
+// nodes: independent redis masters, not cluster nodes, odd number recommended
+func WithRedlockOption(password string, dialTimeout time.Duration, nodes ...string) func(*Options) {
+	return func(opts *Options) {
+		opts.Password = password
+		opts.Cluster = nodes
+		opts.DialTimeout = dialTimeout * time.Millisecond
+		opts.Type = RedlockType
+	}
+}
+
 // WithEtcdOption setting etcd options
 func WithEtcdOption(dialTimeout time.Duration, endpoints ...string) func(*Options) {
 	return func(opts *Options) {
@@ -87,3 +167,86 @@ func WithEtcdAuthOption(user, password, caFile, certFile, keyFile string, skipSS
 		opts.SkipSSL = skipSSL
 	}
 }
+
+// WithKeepAlive renew held locks automatically
+// ctx: stop renewal when done, the lock is lost then, omit
+// onLost: called when the lock is lost, omit
+func WithKeepAlive(ctx context.Context, onLost func(key string, err error)) func(*Options) {
+	return func(opts *Options) {
+		opts.KeepAlive = true
+		opts.KeepAliveCtx = ctx
+		opts.OnLockLost = onLost
+	}
+}
+
+// WithRetryOption setting retry options of blocking Lock
+// interval: first wait interval, default DefaultRetryInterval
+// maxInterval: max wait interval, default DefaultMaxRetryInterval
+// jitter: random ratio of wait interval, 0 ~ 1
+func WithRetryOption(interval, maxInterval time.Duration, jitter float64) func(*Options) {
+	return func(opts *Options) {
+		opts.RetryInterval = interval
+		opts.MaxRetryInterval = maxInterval
+		opts.RetryJitter = jitter
+	}
+}
+
+// WithReentrant enable reentrant lock, the value of Acquire identify the owner
+// all lockers of a key must use the same mode
+func WithReentrant() func(*Options) {
+	return func(opts *Options) {
+		opts.Reentrant = true
+	}
+}
+
+// WithFair enable fair lock, waiters of blocking Lock are granted in arrival order
+// Acquire never jumps ahead of queued waiters, all lockers of a key must use the same mode
+func WithFair() func(*Options) {
+	return func(opts *Options) {
+		opts.Fair = true
+	}
+}
+
+// WithLogger setting logger, logs below level are dropped
+// adapters: NewSlogLogger, NewStdLogger, LoggerFunc
+func WithLogger(logger Logger, level Level) func(*Options) {
+	return func(opts *Options) {
+		if logger == nil {
+			opts.Logger = nil
+			return
+		}
+		opts.Logger = levelLogger{logger: logger, min: level}
+	}
+}
+
+// WithClock setting clock of expiry computation, for tests mostly
+// nil to use the local clock
+func WithClock(clock Clock) func(*Options) {
+	return func(opts *Options) {
+		opts.Clock = clock
+	}
+}
+
+// WithDBClock mysql lock decides expiry by UNIX_TIMESTAMP() of the database server instead of the local clock,
+// so holders with skewed clocks agree on expiry; overrides WithClock for mysql lock
+func WithDBClock() func(*Options) {
+	return func(opts *Options) {
+		opts.DBClock = true
+	}
+}
+
+// logger injected logger, silent if not set
+func (opts Options) logger() Logger {
+	if opts.Logger == nil {
+		return nopLogger{}
+	}
+	return opts.Logger
+}
+
+// clock injected clock, the local clock if not set
+func (opts Options) clock() Clock {
+	if opts.Clock == nil {
+		return systemClock{}
+	}
+	return opts.Clock
+}
@@ -0,0 +1,312 @@
+package dlock
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+)
+
+const (
+	// clockDriftFactor clock drift between redis nodes, ratio of expiration
+	clockDriftFactor = 0.01
+	// clockDriftMin min clock drift between redis nodes
+	clockDriftMin = 2 * time.Millisecond
+
+	// nodeTimeoutDivisor a call to one node times out after expiration/nodeTimeoutDivisor
+	nodeTimeoutDivisor = 10
+	// nodeTimeoutMin min timeout of a call to one node
+	nodeTimeoutMin = 5 * time.Millisecond
+)
+
+// redLock redlock over independent redis masters
+// a lock is acquired only when set on the majority of nodes within its validity time
+type redLock struct {
+	clients []Clienter
+	opts    Options
+}
+
+// redlockHolder lock held on the majority of redis nodes
+type redlockHolder struct {
+	lock  *redLock
+	key   string
+	value string
+	// expiration of acquisition, bound the calls to nodes
+	expiration time.Duration
+}
+
+// NewRedlock create redlock over independent redis masters
+// options: other parameter configs
+func NewRedlock(opts Options) (*redLock, error) {
+	// require check
+	if err := NewValidate().
+		SliceEmpty(opts.Cluster, "redis nodes").
+		ToError(); err != nil {
+		return nil, err
+	}
+	if opts.Reentrant {
+		return nil, fmt.Errorf("reentrant %s lock: %w", RedlockType, NotSupportedTypeLockErr)
+	}
+	if opts.Fair {
+		return nil, fmt.Errorf("fair %s lock: %w", RedlockType, NotSupportedTypeLockErr)
+	}
+
+	l := &redLock{opts: opts}
+	for _, addr := range opts.Cluster {
+		l.clients = append(l.clients, redis.NewClient(&redis.Options{
+			Addr:        addr,
+			Password:    opts.Password,
+			DialTimeout: opts.DialTimeout,
+		}))
+	}
+
+	// client ping, the majority of nodes must be available
+	_, errs := l.each(func(c Clienter) (int64, error) {
+		return 0, c.Ping().Err()
+	})
+	if failed := countErr(errs); failed > len(l.clients)-l.quorum() {
+		opts.logger().Log(LevelError, "redlock nodes ping fail", "failed", failed, "nodes", len(l.clients), "err", firstErr(errs))
+		_ = l.Close()
+		return nil, unavailableErr(firstErr(errs))
+	}
+
+	return l, nil
+}
+
+// Acquire 获取锁
+// return ErrLockHeld if not acquired on the majority of nodes in time
+// return ErrBackendUnavailable if too many nodes fail
+// fencing token is the max counter of nodes, not strictly monotonic when nodes fail
+// return ErrNoExpiration if expiration <= 0, the validity time is part of expiration
+func (l *redLock) Acquire(ctx context.Context, expiration time.Duration, key, value, host string) (Lock, error) {
+	if expiration <= 0 {
+		return nil, noExpirationErr(key, expiration)
+	}
+
+	clock := l.opts.clock()
+	start := clock.Now()
+	tokens, errs := l.each(func(c Clienter) (int64, error) {
+		ctx, cancel := nodeCtx(ctx, expiration)
+		defer cancel()
+		return acquireScript.Run(withContext(ctx, c), []string{key, fencingKey(key)}, value, expiration.Milliseconds()).Int64()
+	})
+
+	var acquired, token int64
+	for i := range tokens {
+		if errs[i] == nil && tokens[i] > 0 {
+			acquired++
+			if tokens[i] > token {
+				token = tokens[i]
+			}
+		}
+	}
+
+	holder := &redlockHolder{lock: l, key: key, value: value, expiration: expiration}
+	validity := expiration - clock.Now().Sub(start) - clockDrift(expiration)
+	if int(acquired) >= l.quorum() && validity > 0 {
+		return newHandleAt(key, value, token, expiration, start.Add(validity), holder, l.opts), nil
+	}
+
+	// roll back the nodes already set
+	_ = holder.release(context.Background())
+
+	// too many nodes fail, report backend error instead of lock held
+	if countErr(errs) > len(l.clients)-l.quorum() {
+		return nil, quorumErr(key, errs)
+	}
+	return nil, heldErr(key)
+}
+
+// Lock block until the lock is acquired or ctx done
+func (l *redLock) Lock(ctx context.Context, expiration time.Duration, key, value, host string) (Lock, error) {
+	return waitLock(ctx, l.opts, key, func(ctx context.Context) (Lock, error) {
+		return l.Acquire(ctx, expiration, key, value, host)
+	})
+}
+
+// GetValue get the value held by the majority of nodes, "" if not locked
+func (l *redLock) GetValue(ctx context.Context, key string) (string, error) {
+	// every goroutine writes its own index
+	values := make([]string, len(l.clients))
+	_, errs := l.eachIndex(func(i int, c Clienter) (int64, error) {
+		value, err := withContext(ctx, c).Get(key).Result()
+		if err == redis.Nil {
+			err = nil
+		}
+		values[i] = value
+		return 0, err
+	})
+
+	counts := map[string]int{}
+	for i, value := range values {
+		if errs[i] == nil && len(value) > 0 {
+			counts[value]++
+			if counts[value] >= l.quorum() {
+				return value, nil
+			}
+		}
+	}
+	if countErr(errs) > len(l.clients)-l.quorum() {
+		return "", quorumErr(key, errs)
+	}
+	return "", nil
+}
+
+// GetType  get lock type
+func (l *redLock) GetType() string {
+	return RedlockType
+}
+
+// Close close clients of all nodes, locks held are not released
+func (l *redLock) Close() error {
+	var errs []error
+	for _, c := range l.clients {
+		errs = append(errs, c.Close())
+	}
+	return firstErr(errs)
+}
+
+// quorum majority of nodes
+func (l *redLock) quorum() int {
+	return len(l.clients)/2 + 1
+}
+
+// each run fn on all nodes concurrently
+func (l *redLock) each(fn func(c Clienter) (int64, error)) ([]int64, []error) {
+	return l.eachIndex(func(i int, c Clienter) (int64, error) {
+		return fn(c)
+	})
+}
+
+// eachIndex run fn on all nodes concurrently, results are in order of nodes
+func (l *redLock) eachIndex(fn func(i int, c Clienter) (int64, error)) ([]int64, []error) {
+	results := make([]int64, len(l.clients))
+	errs := make([]error, len(l.clients))
+
+	var wg sync.WaitGroup
+	for i := range l.clients {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = fn(i, l.clients[i])
+		}(i)
+	}
+	wg.Wait()
+	return results, errs
+}
+
+// release delete key on all nodes where value matches
+// fan out to every node, even those not acquired
+func (h *redlockHolder) release(ctx context.Context) error {
+	deleted, errs := h.lock.each(func(c Clienter) (int64, error) {
+		ctx, cancel := nodeCtx(ctx, h.expiration)
+		defer cancel()
+		return unlockScript.Run(withContext(ctx, c), []string{h.key}, h.value).Int64()
+	})
+	for i := range deleted {
+		if errs[i] == nil && deleted[i] > 0 {
+			return nil
+		}
+	}
+	if err := firstErr(errs); err != nil {
+		return err
+	}
+	return ErrNotOwner
+}
+
+// refresh extend ttl on all nodes, must succeed on the majority
+func (h *redlockHolder) refresh(ctx context.Context, expiration time.Duration) error {
+	clock := h.lock.opts.clock()
+	start := clock.Now()
+	renewed, errs := h.lock.each(func(c Clienter) (int64, error) {
+		ctx, cancel := nodeCtx(ctx, expiration)
+		defer cancel()
+		return renewScript.Run(withContext(ctx, c), []string{h.key}, h.value, expiration.Milliseconds()).Int64()
+	})
+
+	var count int
+	for i := range renewed {
+		if errs[i] == nil && renewed[i] > 0 {
+			count++
+		}
+	}
+	if count >= h.lock.quorum() && clock.Now().Sub(start)+clockDrift(expiration) < expiration {
+		return nil
+	}
+	if countErr(errs) > len(h.lock.clients)-h.lock.quorum() {
+		return firstErr(errs)
+	}
+	return ErrNotOwner
+}
+
+// ttl the ttl still held by the majority of nodes
+func (h *redlockHolder) ttl(ctx context.Context) (time.Duration, error) {
+	ms, errs := h.lock.each(func(c Clienter) (int64, error) {
+		return ttlScript.Run(withContext(ctx, c), []string{h.key}, h.value).Int64()
+	})
+
+	var ttls []int64
+	for i := range ms {
+		if errs[i] == nil && ms[i] != -3 {
+			ttls = append(ttls, ms[i])
+		}
+	}
+	if len(ttls) < h.lock.quorum() {
+		if countErr(errs) > len(h.lock.clients)-h.lock.quorum() {
+			return 0, firstErr(errs)
+		}
+		return 0, ErrNotOwner
+	}
+
+	// the quorum-th largest ttl, lock expires on the majority after it
+	sort.Slice(ttls, func(i, j int) bool { return ttls[i] > ttls[j] })
+	ttl := time.Duration(ttls[h.lock.quorum()-1]) * time.Millisecond
+	if ttl < 0 {
+		// no expiration
+		return 0, nil
+	}
+	return ttl - clockDrift(ttl), nil
+}
+
+// clockDrift clock drift allowed for expiration
+func clockDrift(expiration time.Duration) time.Duration {
+	return time.Duration(float64(expiration)*clockDriftFactor) + clockDriftMin
+}
+
+// nodeCtx ctx of a call to one node, time out after a small fraction of expiration
+// so that a slow node can not eat up the validity time, no timeout if no expiration
+func nodeCtx(ctx context.Context, expiration time.Duration) (context.Context, context.CancelFunc) {
+	if expiration <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, max(expiration/nodeTimeoutDivisor, nodeTimeoutMin))
+}
+
+// countErr count non-nil errors
+func countErr(errs []error) int {
+	var count int
+	for _, err := range errs {
+		if err != nil {
+			count++
+		}
+	}
+	return count
+}
+
+// quorumErr the majority of nodes fail, the lock can not be decided
+func quorumErr(key string, errs []error) error {
+	return fmt.Errorf("lock %s: %w: %d of %d redlock nodes fail: %w", key, ErrBackendUnavailable, countErr(errs), len(errs), firstErr(errs))
+}
+
+// firstErr first non-nil error
+func firstErr(errs []error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
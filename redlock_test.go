@@ -0,0 +1,187 @@
+package dlock
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v7"
+)
+
+// startRedlockNodes start n in-process redis servers
+func startRedlockNodes(t *testing.T, n int) ([]*miniredis.Miniredis, []string) {
+	var nodes []*miniredis.Miniredis
+	var addrs []string
+	for i := 0; i < n; i++ {
+		mr := miniredis.RunT(t)
+		nodes = append(nodes, mr)
+		addrs = append(addrs, mr.Addr())
+	}
+	return nodes, addrs
+}
+
+func TestRedlock_Acquire(t *testing.T) {
+	nodes, addrs := startRedlockNodes(t, 3)
+	ctx := context.Background()
+
+	l, err := NewLocker(WithRedlockOption("", dialTimeout, addrs...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lock, err := l.Acquire(ctx, time.Minute, key, value, host)
+	if err != nil || lock == nil {
+		t.Fatalf("acquire fail, lock: %v, err: %v", lock, err)
+	}
+	for i, mr := range nodes {
+		if got, _ := mr.Get(key); got != value {
+			t.Fatalf("node %d value: %s, want: %s", i, got, value)
+		}
+	}
+	if v, err := l.GetValue(ctx, key); err != nil || v != value {
+		t.Fatalf("lock value: %s, err: %v", v, err)
+	}
+	if held, err := l.Acquire(ctx, time.Minute, key, "other", host); !errors.Is(err, ErrLockHeld) || held != nil {
+		t.Fatalf("acquire held lock, lock: %v, err: %v", held, err)
+	}
+
+	// release fan out to all nodes
+	if err = lock.Release(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for i, mr := range nodes {
+		if mr.Exists(key) {
+			t.Fatalf("node %d not released", i)
+		}
+	}
+}
+
+func TestRedlock_Quorum(t *testing.T) {
+	nodes, addrs := startRedlockNodes(t, 3)
+	ctx := context.Background()
+
+	l, err := NewLocker(WithRedlockOption("", dialTimeout, addrs...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// minority held by others, still acquired on the majority
+	nodes[0].Set(key, "other")
+	lock, err := l.Acquire(ctx, time.Minute, key, value, host)
+	if err != nil || lock == nil {
+		t.Fatalf("acquire with minority held, lock: %v, err: %v", lock, err)
+	}
+	if err = lock.Release(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// majority held by others, roll back the node acquired
+	nodes[1].Set(key, "other")
+	if lock, err = l.Acquire(ctx, time.Minute, key, value, host); !errors.Is(err, ErrLockHeld) || lock != nil {
+		t.Fatalf("acquire with majority held, lock: %v, err: %v", lock, err)
+	}
+	if nodes[2].Exists(key) {
+		t.Fatal("minority acquisition not rolled back")
+	}
+
+	// minority node down, still acquired
+	nodes[0].Del(key)
+	nodes[1].Del(key)
+	nodes[0].Close()
+	if lock, err = l.Acquire(ctx, time.Minute, key, value, host); err != nil || lock == nil {
+		t.Fatalf("acquire with minority down, lock: %v, err: %v", lock, err)
+	}
+	if ttl, err := lock.TTL(ctx); err != nil || ttl <= 0 {
+		t.Fatalf("ttl: %s, err: %v", ttl, err)
+	}
+	if err = lock.Refresh(ctx, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err = lock.Release(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// majority node down, backend error
+	nodes[1].Close()
+	if lock, err = l.Acquire(ctx, time.Minute, key, value, host); !errors.Is(err, ErrBackendUnavailable) || lock != nil {
+		t.Fatalf("acquire with majority down, lock: %v, err: %v", lock, err)
+	}
+}
+
+// startSlowNode start a node accepting connections but never replying
+func startSlowNode(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+
+	go func() {
+		var conns []net.Conn
+		defer func() {
+			for _, conn := range conns {
+				_ = conn.Close()
+			}
+		}()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestRedlock_SlowNode(t *testing.T) {
+	_, addrs := startRedlockNodes(t, 2)
+	l := &redLock{}
+	for _, addr := range append(addrs, startSlowNode(t)) {
+		client := redis.NewClient(&redis.Options{Addr: addr})
+		t.Cleanup(func() { _ = client.Close() })
+		l.clients = append(l.clients, client)
+	}
+
+	// the slow node times out after expiration/10, within the validity time
+	start := time.Now()
+	lock, err := l.Acquire(context.Background(), time.Second, key, value, host)
+	if err != nil || lock == nil {
+		t.Fatalf("acquire with slow node, lock: %v, err: %v", lock, err)
+	}
+	if err = lock.Refresh(context.Background(), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err = lock.Release(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("calls wait for the slow node, elapsed: %s", elapsed)
+	}
+}
+
+func TestRedlock_ExpireAt(t *testing.T) {
+	_, addrs := startRedlockNodes(t, 3)
+	clock := newFakeClock()
+	l, err := NewLocker(WithRedlockOption("", dialTimeout, addrs...), WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// validity time on the injected clock, the clock is still while acquiring
+	lock, err := l.Acquire(context.Background(), time.Minute, key, value, host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := clock.Now().Add(time.Minute - clockDrift(time.Minute)); !lock.ExpireAt().Equal(want) {
+		t.Fatalf("expire at: %s, want: %s", lock.ExpireAt(), want)
+	}
+
+	// validity time is part of expiration, no lock without expiration
+	if _, err = l.Acquire(context.Background(), 0, "forever", value, host); !errors.Is(err, ErrNoExpiration) {
+		t.Fatalf("acquire without expiration, err: %v", err)
+	}
+}
@@ -0,0 +1,90 @@
+package dlock
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+)
+
+const (
+	// DefaultRetryInterval first wait interval of blocking Lock
+	DefaultRetryInterval = 50 * time.Millisecond
+	// DefaultMaxRetryInterval max wait interval of blocking Lock
+	DefaultMaxRetryInterval = 2 * time.Second
+	// backoffFactor interval grows by factor after every failed try
+	backoffFactor = 2
+)
+
+// backoff exponential backoff with jitter
+type backoff struct {
+	next   time.Duration
+	max    time.Duration
+	jitter float64
+}
+
+// newBackoff create backoff from retry options
+func newBackoff(opts Options) *backoff {
+	b := &backoff{next: opts.RetryInterval, max: opts.MaxRetryInterval, jitter: opts.RetryJitter}
+	if b.next <= 0 {
+		b.next = DefaultRetryInterval
+	}
+	if b.max <= 0 {
+		b.max = DefaultMaxRetryInterval
+	}
+	if b.max < b.next {
+		b.max = b.next
+	}
+	return b
+}
+
+// Next wait interval of next retry
+// interval * (1 ± jitter), then interval grows until max
+func (b *backoff) Next() time.Duration {
+	wait := b.next
+	if b.jitter > 0 {
+		wait += time.Duration((rand.Float64()*2 - 1) * b.jitter * float64(wait))
+	}
+
+	if b.next *= backoffFactor; b.next > b.max {
+		b.next = b.max
+	}
+	return wait
+}
+
+// waitLock call try until the lock is acquired or ctx done
+// try return ErrLockHeld if contended, retried; ErrBackendUnavailable is logged and retried;
+// other errors are returned at once, return ctx.Err() if ctx done first
+func waitLock(ctx context.Context, opts Options, key string, try func(ctx context.Context) (Lock, error)) (Lock, error) {
+	b := newBackoff(opts)
+	for {
+		lock, err := try(ctx)
+		switch {
+		case err == nil:
+			return lock, nil
+		case ctxErr(ctx) != nil:
+			return nil, ctxErr(ctx)
+		case errors.Is(err, ErrBackendUnavailable):
+			opts.logger().Log(LevelWarn, "acquire lock fail, retry later", "key", key, "err", err)
+		case !errors.Is(err, ErrLockHeld):
+			return nil, err
+		}
+
+		timer := time.NewTimer(b.Next())
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// ctxErr error of ctx, DeadlineExceeded as soon as the deadline passed
+// a backend call cut off by the deadline may return before ctx is marked done
+func ctxErr(ctx context.Context) error {
+	if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+		return context.DeadlineExceeded
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,45 @@
+package dlock
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func Test_waitLock(t *testing.T) {
+	opts := Options{RetryInterval: time.Millisecond, MaxRetryInterval: 5 * time.Millisecond}
+	held := &handle{key: key}
+
+	// contention and outage retried
+	var tries int
+	lock, err := waitLock(timeoutCtx(t, time.Second), opts, key, func(context.Context) (Lock, error) {
+		switch tries++; tries {
+		case 1:
+			return nil, heldErr(key)
+		case 2:
+			return nil, unavailableErr(errors.New("connection refused"))
+		}
+		return held, nil
+	})
+	if err != nil || lock != held || tries != 3 {
+		t.Fatalf("lock: %v, tries: %d, err: %v", lock, tries, err)
+	}
+
+	// other errors returned at once
+	fail := errors.New("fail")
+	tries = 0
+	if _, err = waitLock(timeoutCtx(t, time.Second), opts, key, func(context.Context) (Lock, error) {
+		tries++
+		return nil, fail
+	}); err != fail || tries != 1 {
+		t.Fatalf("tries: %d, err: %v", tries, err)
+	}
+
+	// ctx done
+	if _, err = waitLock(timeoutCtx(t, 20*time.Millisecond), opts, key, func(context.Context) (Lock, error) {
+		return nil, heldErr(key)
+	}); err != context.DeadlineExceeded {
+		t.Fatalf("ctx done, err: %v", err)
+	}
+}
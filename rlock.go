@@ -1,7 +1,9 @@
 package dlock
 
 import (
-	"sync"
+	"context"
+	"fmt"
+	"strconv"
 	"time"
 
 	"github.com/go-redis/redis/v7"
@@ -10,20 +12,142 @@ import (
 // rLock redis lock
 type rLock struct {
 	// redis cluster client
-	rc  Clienter
-	mux *sync.Mutex
+	rc   Clienter
+	opts Options
+	// client created by rLock, closed by Close
+	ownClient bool
+}
+
+// redisHolder lock held on redis
+type redisHolder struct {
+	rc      Clienter
+	scripts *redisScripts
+	key     string
+	value   string
+}
+
+// redisScripts lua scripts of one lock mode
+// KEYS[1]: lock key, ARGV[1]: lock value
+type redisScripts struct {
+	// KEYS[2]: fencing key, ARGV[2]: expiration ms; return fencing token, 0 if held by others
+	acquire *redis.Script
+	// return 0 if not held by value
+	release *redis.Script
+	// ARGV[2]: expiration ms; return 0 if not held by value
+	renew *redis.Script
+	// return ttl ms, -3 if not held by value
+	ttl *redis.Script
+	// return value of holder, nil if not locked
+	value *redis.Script
+}
+
+// plainScripts lock is a string key: value
+var plainScripts = &redisScripts{
+	acquire: acquireScript,
+	release: unlockScript,
+	renew:   renewScript,
+	ttl:     ttlScript,
+	value:   redis.NewScript(`return redis.call("get", KEYS[1])`),
+}
 
-	key        string
-	value      interface{}
-	expiration time.Duration
+// reentrantScripts lock is a hash key: {owner: value, count: hold count, token: fencing token}
+var reentrantScripts = &redisScripts{
+	acquire: redis.NewScript(fencingPrelude + `
+local owner = redis.call("hget", KEYS[1], "owner")
+local token
+if not owner then
+	token = nextToken(KEYS[2])
+	redis.call("hset", KEYS[1], "owner", ARGV[1], "count", 1, "token", token)
+elseif owner == ARGV[1] then
+	redis.call("hincrby", KEYS[1], "count", 1)
+	token = tonumber(redis.call("hget", KEYS[1], "token"))
+else
+	return 0
+end
+if tonumber(ARGV[2]) > 0 then
+	redis.call("pexpire", KEYS[1], ARGV[2])
+end
+return token
+`),
+	release: redis.NewScript(`
+if redis.call("hget", KEYS[1], "owner") ~= ARGV[1] then
+	return 0
+end
+if redis.call("hincrby", KEYS[1], "count", -1) <= 0 then
+	redis.call("del", KEYS[1])
+end
+return 1
+`),
+	renew: redis.NewScript(`
+if redis.call("hget", KEYS[1], "owner") == ARGV[1] then
+	return redis.call("pexpire", KEYS[1], ARGV[2])
+end
+return 0
+`),
+	ttl: redis.NewScript(`
+if redis.call("hget", KEYS[1], "owner") == ARGV[1] then
+	return redis.call("pttl", KEYS[1])
+end
+return -3
+`),
+	value: redis.NewScript(`return redis.call("hget", KEYS[1], "owner")`),
 }
 
-// global redis cluster client
-var rc Clienter
+// acquireScript set key if not exists, and increase the fencing counter
+// return fencing token, 0 if key exists
+var acquireScript = redis.NewScript(fencingPrelude + `
+local ok
+if tonumber(ARGV[2]) > 0 then
+	ok = redis.call("set", KEYS[1], ARGV[1], "NX", "PX", ARGV[2])
+else
+	ok = redis.call("set", KEYS[1], ARGV[1], "NX")
+end
+if ok then
+	return nextToken(KEYS[2])
+end
+return 0
+`)
+
+// unlockScript delete key only if value matches, compare-and-delete
+var unlockScript = redis.NewScript(`
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("del", KEYS[1])
+end
+return 0
+`)
 
-// NewRLock create redis distributed lock
+// renewScript extend key ttl only if value matches
+var renewScript = redis.NewScript(`
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("pexpire", KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+// ttlScript key ttl in milliseconds only if value matches, -3 if not
+var ttlScript = redis.NewScript(`
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("pttl", KEYS[1])
+end
+return -3
+`)
+
+// NewRLock create redis distributed lock, with its own client
 // options: other parameter configs
 func NewRLock(opts Options) (*rLock, error) {
+	if opts.Fair && opts.Reentrant {
+		return nil, fmt.Errorf("fair reentrant %s lock: %w", RedisLockType, NotSupportedTypeLockErr)
+	}
+
+	// caller-supplied client, reused as it is
+	if opts.RedisClient != nil {
+		if _, err := opts.RedisClient.Ping().Result(); err != nil {
+			opts.logger().Log(LevelError, "redis client ping fail", "err", err)
+			return nil, unavailableErr(err)
+		}
+		return &rLock{rc: opts.RedisClient, opts: opts}, nil
+	}
+
 	// require check
 	if err := NewValidate().
 		SliceEmpty(opts.Cluster, "redis cluster").
@@ -32,69 +156,74 @@ func NewRLock(opts Options) (*rLock, error) {
 		return nil, err
 	}
 
-	if rc == nil {
-		once.Do(func() {
-			if len(opts.Cluster) > 1 {
-				rc = redis.NewClusterClient(&redis.ClusterOptions{
-					Addrs:       opts.Cluster,
-					Password:    opts.Password,
-					DialTimeout: opts.DialTimeout,
-				})
-			} else {
-				rc = redis.NewClient(&redis.Options{
-					Addr:        opts.Cluster[0],
-					Password:    opts.Password,
-					DialTimeout: opts.DialTimeout,
-				})
-			}
-
+	var rc Clienter
+	if len(opts.Cluster) > 1 {
+		rc = redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:       opts.Cluster,
+			Password:    opts.Password,
+			DialTimeout: opts.DialTimeout,
 		})
+	} else {
+		rc = redis.NewClient(&redis.Options{
+			Addr:        opts.Cluster[0],
+			Password:    opts.Password,
+			DialTimeout: opts.DialTimeout,
+		})
+	}
 
-		// client ping
-		// ignore result string PONG
-		if _, err := rc.Ping().Result(); err != nil {
-			Errorf("redis cluster client ping fail, %v", err)
-			return nil, err
-		}
+	// client ping
+	// ignore result string PONG
+	if _, err := rc.Ping().Result(); err != nil {
+		opts.logger().Log(LevelError, "redis client ping fail", "addrs", opts.Cluster, "err", err)
+		_ = rc.Close()
+		return nil, unavailableErr(err)
 	}
 
 	return &rLock{
-		rc:  rc,
-		mux: &sync.Mutex{},
+		rc:        rc,
+		opts:      opts,
+		ownClient: true,
 	}, nil
 }
 
 // Acquire 获取锁
-func (l *rLock) Acquire(expiration time.Duration, key, value, host string) (bool, error) {
-	//// TODO 添加自动续租功能
-	succ, err := l.rc.SetNX(key, value, expiration).Result()
+// return ErrLockHeld if held by others
+// reentrant: the same value can acquire again, increase hold count of the hash
+// fair: acquire only if no waiter is queued
+func (l *rLock) Acquire(ctx context.Context, expiration time.Duration, key, value, host string) (Lock, error) {
+	if l.opts.Fair {
+		return l.tryFair(ctx, expiration, 0, key, value, host, holderID())
+	}
+	scripts := l.scripts()
+	token, err := scripts.acquire.Run(withContext(ctx, l.rc), []string{key, fencingKey(key)}, value, expiration.Milliseconds()).Int64()
 	if err != nil {
-		l.rc.Del(l.key)
+		return nil, backendErr(key, err)
 	}
-	return succ, err
-}
-
-// IsLock check if is locked already
-// If key expire, redis will return ---> redis: nil
-func (l *rLock) IsLock(key string) (bool, error) {
-	if str, err := l.rc.Get(key).Result(); err != nil {
-		if err.Error() == "redis: nil" {
-			return false, nil
-		}
-		return false, err
-	} else {
-		return len(str) > 0, nil
+	if token <= 0 {
+		return nil, heldErr(key)
 	}
+	return newHandle(key, value, token, expiration, &redisHolder{rc: l.rc, scripts: scripts, key: key, value: value}, l.opts), nil
 }
 
-// UnLock release lock
-func (l *rLock) UnLock(key string) (err error) {
-	return l.rc.Del(key).Err()
+// Lock block until the lock is acquired or ctx done
+// fair: wait in the queue of key, see WithFair
+func (l *rLock) Lock(ctx context.Context, expiration time.Duration, key, value, host string) (Lock, error) {
+	if l.opts.Fair {
+		return waitFair(ctx, l.opts, l, expiration, key, value, host)
+	}
+	return waitLock(ctx, l.opts, key, func(ctx context.Context) (Lock, error) {
+		return l.Acquire(ctx, expiration, key, value, host)
+	})
 }
 
-// GetLockID  get lock value
-func (l *rLock) GetValue(key string) (value string) {
-	return l.rc.Get(key).String()
+// GetValue get lock value, "" if not locked
+// If key expire, redis will return ---> redis: nil
+func (l *rLock) GetValue(ctx context.Context, key string) (string, error) {
+	value, err := l.scripts().value.Run(withContext(ctx, l.rc), []string{key}).Text()
+	if err == redis.Nil {
+		return "", nil
+	}
+	return value, backendErr(key, err)
 }
 
 // GetType  get lock type
@@ -102,6 +231,107 @@ func (l *rLock) GetType() string {
 	return RedisLockType
 }
 
+// Close close redis client if created by rLock, locks held are not released
+func (l *rLock) Close() error {
+	if !l.ownClient {
+		return nil
+	}
+	return l.rc.Close()
+}
+
+// scripts lua scripts of lock mode
+func (l *rLock) scripts() *redisScripts {
+	if l.opts.Reentrant {
+		return reentrantScripts
+	}
+	return plainScripts
+}
+
+// release delete key only if value matches
+func (h *redisHolder) release(ctx context.Context) error {
+	deleted, err := h.scripts.release.Run(withContext(ctx, h.rc), []string{h.key}, h.value).Int64()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return ErrNotOwner
+	}
+	return nil
+}
+
+// refresh extend ttl of the lock held by value
+func (h *redisHolder) refresh(ctx context.Context, expiration time.Duration) error {
+	renewed, err := h.scripts.renew.Run(withContext(ctx, h.rc), []string{h.key}, h.value, expiration.Milliseconds()).Int64()
+	if err != nil {
+		return err
+	}
+	if renewed == 0 {
+		return ErrNotOwner
+	}
+	return nil
+}
+
+// ttl remaining ttl of the lock held by value
+func (h *redisHolder) ttl(ctx context.Context) (time.Duration, error) {
+	ms, err := h.scripts.ttl.Run(withContext(ctx, h.rc), []string{h.key}, h.value).Int64()
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case ms == -3:
+		return 0, ErrNotOwner
+	case ms < 0:
+		// no expiration
+		return 0, nil
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+// fencingKey counter key of fencing token, expire after fencingTTL without acquisition
+func fencingKey(key string) string {
+	return tagKey(key, "fencing")
+}
+
+// fencingTTL expiration of fencing counter, refreshed on every increase
+const fencingTTL = 7 * 24 * time.Hour
+
+// fencingPrelude lua function nextToken(k): increase fencing counter k and refresh its expiration
+// an expired counter restarts from redis server time in microseconds, so tokens keep increasing
+// as long as a key is acquired less than once per microsecond on average
+var fencingPrelude = `
+local function nextToken(k)
+	if redis.call("exists", k) == 0 then
+		local t = redis.call("time")
+		redis.call("set", k, t[1] .. string.format("%06d", tonumber(t[2])))
+	end
+	local token = redis.call("incr", k)
+	redis.call("pexpire", k, ` + strconv.FormatInt(fencingTTL.Milliseconds(), 10) + `)
+	return token
+end
+`
+
+// tagKey key derived from lock key
+// share the hash tag of key, so they are in the same slot of redis cluster
+func tagKey(key, suffix string) string {
+	if len(hashTag(key)) > 0 {
+		return key + ":" + suffix
+	}
+	return "{" + key + "}:" + suffix
+}
+
+// withContext bind ctx to redis client
+// only *redis.Client and *redis.ClusterClient support context, others return as it is
+func withContext(ctx context.Context, c Clienter) Clienter {
+	switch client := c.(type) {
+	case *redis.Client:
+		return client.WithContext(ctx)
+	case *redis.ClusterClient:
+		return client.WithContext(ctx)
+	default:
+		return c
+	}
+}
+
 // Clienter  redis client
 // adapter ClusterClient && Client
 type Clienter interface {
@@ -109,4 +339,11 @@ type Clienter interface {
 	Del(keys ...string) *redis.IntCmd
 	Get(key string) *redis.StringCmd
 	Ping() *redis.StatusCmd
+	Close() error
+
+	// lua script
+	Eval(script string, keys []string, args ...interface{}) *redis.Cmd
+	EvalSha(sha1 string, keys []string, args ...interface{}) *redis.Cmd
+	ScriptExists(hashes ...string) *redis.BoolSliceCmd
+	ScriptLoad(script string) *redis.StringCmd
 }
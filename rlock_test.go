@@ -1,51 +1,488 @@
 package dlock
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
-)
 
-const (
-	dialTimeout = 120
-	cluster     = "10.0.3.59:7000,10.0.3.59:7001,10.0.3.59:7002,10.0.3.59:7003,10.0.3.59:7004,10.0.3.59:7005,10.0.3.59:7006"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v7"
 )
 
-func TestRLock_Acquire(t *testing.T) {
-	l, err := NewDLock(
-		WithRedisOption(password, dialTimeout, cluster))
+const dialTimeout = 120
 
+func TestRLock_Acquire(t *testing.T) {
+	mr := miniredis.RunT(t)
+	l, err := NewDLock(WithRedisOption("", dialTimeout, mr.Addr()))
 	if err != nil {
-		t.Error(err)
-		return
+		t.Fatal(err)
 	}
+	defer l.Close()
 
 	success, err := l.Acquire(5*time.Minute, key, value, host)
-	if err != nil {
-		t.Error(err)
-		return
+	if err != nil || !success {
+		t.Fatalf("acquire fail, success: %t, err: %v", success, err)
+	}
+	if got := l.GetValue(key); got != value {
+		t.Fatalf("lock value: %s, want: %s", got, value)
+	}
+	if ttl := mr.TTL(key); ttl != 5*time.Minute {
+		t.Fatalf("lock ttl: %s, want: %s", ttl, 5*time.Minute)
+	}
+	if success, err = l.Acquire(5*time.Minute, key, "other", host); err != nil || success {
+		t.Fatalf("acquire held lock, success: %t, err: %v", success, err)
 	}
-	t.Logf("lock status : %t, value :%s", success, l.GetValue(value))
 }
 
 func TestRLock_Release(t *testing.T) {
-	l, err := NewDLock(
-		WithRedisOption(password, dialTimeout, cluster))
+	mr := miniredis.RunT(t)
+	l, err := NewDLock(WithRedisOption("", dialTimeout, mr.Addr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	if success, err := l.Acquire(5*time.Minute, key, value, host); err != nil || !success {
+		t.Fatalf("acquire fail, success: %t, err: %v", success, err)
+	}
+	mr.FastForward(30 * time.Second)
+	if err = l.UnLock(key); err != nil {
+		t.Fatal(err)
+	}
+	if mr.Exists(key) {
+		t.Fatal("lock not released")
+	}
+
+	// expired before released
+	if success, err := l.Acquire(time.Minute, key, value, host); err != nil || !success {
+		t.Fatalf("acquire fail, success: %t, err: %v", success, err)
+	}
+	mr.FastForward(2 * time.Minute)
+	if err = l.UnLock(key); !errors.Is(err, ErrNotOwner) {
+		t.Fatalf("unlock expired lock, err: %v", err)
+	}
+}
+
+func TestRLock_Cluster(t *testing.T) {
+	mr := miniredis.RunT(t)
 
+	// more than one address: cluster client, slots served by the only node
+	l, err := NewDLock(WithRedisOption("", dialTimeout, mr.Addr(), mr.Addr()))
 	if err != nil {
-		t.Error(err)
-		return
+		t.Fatal(err)
 	}
+	defer l.Close()
 
-	success, err := l.Acquire(5*time.Minute, key, value, host)
+	if success, err := l.Acquire(time.Minute, key, value, host); err != nil || !success {
+		t.Fatalf("acquire fail, success: %t, err: %v", success, err)
+	}
+	if got, _ := mr.Get(key); got != value {
+		t.Fatalf("lock value: %s, want: %s", got, value)
+	}
+	if err = l.UnLock(key); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRLock_Concurrent(t *testing.T) {
+	mr := miniredis.RunT(t)
+
+	// only one of the contenders acquires
+	var acquired int32
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			l := newMiniDLock(t, mr)
+			success, err := l.Acquire(time.Minute, key, fmt.Sprintf("value_%d", i), host)
+			if err != nil {
+				t.Error(err)
+			}
+			if success {
+				atomic.AddInt32(&acquired, 1)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if acquired != 1 {
+		t.Fatalf("acquired by %d contenders", acquired)
+	}
+
+	// expired by fake clock, acquired by one more
+	mr.FastForward(2 * time.Minute)
+	if success, err := newMiniDLock(t, mr).Acquire(time.Minute, key, "late", host); err != nil || !success {
+		t.Fatalf("acquire expired lock, success: %t, err: %v", success, err)
+	}
+}
+
+// newMiniRLock create redis lock on an in-process redis server
+func newMiniRLock(t *testing.T, mr *miniredis.Miniredis, options ...func(*Options)) *rLock {
+	var opts Options
+	for i := range options {
+		options[i](&opts)
+	}
+
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { _ = client.Close() })
+	return &rLock{rc: client, opts: opts}
+}
+
+// newMiniDLock create DLock on an in-process redis server
+func newMiniDLock(t *testing.T, mr *miniredis.Miniredis, options ...func(*Options)) DLock {
+	return newDLock(newMiniRLock(t, mr, options...))
+}
+
+func TestRLock_UnLockNotOwner(t *testing.T) {
+	mr := miniredis.RunT(t)
+	l, other := newMiniDLock(t, mr), newMiniDLock(t, mr)
+
+	success, err := l.Acquire(time.Minute, key, value, host)
+	if err != nil || !success {
+		t.Fatalf("acquire fail, success: %t, err: %v", success, err)
+	}
+
+	// never acquired by other
+	if err = other.UnLock(key); err != ErrNotOwner {
+		t.Fatalf("unlock by other, err: %v", err)
+	}
+	if !mr.Exists(key) {
+		t.Fatal("lock released by other")
+	}
+
+	// expired, then acquired by other
+	mr.FastForward(2 * time.Minute)
+	if success, err = other.Acquire(time.Minute, key, "other", host); err != nil || !success {
+		t.Fatalf("acquire expired lock, success: %t, err: %v", success, err)
+	}
+	if err = l.UnLock(key); err != ErrNotOwner {
+		t.Fatalf("unlock expired lock, err: %v", err)
+	}
+	if got, _ := mr.Get(key); got != "other" {
+		t.Fatalf("lock value: %s, want: other", got)
+	}
+
+	if err = other.UnLock(key); err != nil {
+		t.Fatal(err)
+	}
+	if mr.Exists(key) {
+		t.Fatal("lock not released by owner")
+	}
+}
+
+func TestRLock_KeepAlive(t *testing.T) {
+	mr := miniredis.RunT(t)
+	lost := make(chan string, 1)
+	l := newMiniDLock(t, mr, WithKeepAlive(context.Background(), func(key string, err error) {
+		lost <- key
+	}))
+
+	success, err := l.Acquire(300*time.Millisecond, key, value, host)
+	if err != nil || !success {
+		t.Fatalf("acquire fail, success: %t, err: %v", success, err)
+	}
+
+	// ttl is extended by watchdog
+	mr.FastForward(250 * time.Millisecond)
+	time.Sleep(200 * time.Millisecond)
+	if ttl := mr.TTL(key); ttl <= 100*time.Millisecond {
+		t.Fatalf("lock not renewed, ttl: %s", ttl)
+	}
+
+	// taken over by others, renewal fail
+	mr.Set(key, "other")
+	select {
+	case k := <-lost:
+		if k != key {
+			t.Fatalf("lost key: %s, want: %s", k, key)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("lock lost not reported")
+	}
+}
+
+func TestRLock_KeepAliveCtx(t *testing.T) {
+	mr := miniredis.RunT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	lost := make(chan error, 1)
+	l := newMiniRLock(t, mr, WithKeepAlive(ctx, func(key string, err error) {
+		lost <- err
+	}))
+
+	// never expire, nothing to renew
+	if _, err := l.Acquire(context.Background(), 0, "forever", value, host); err != nil {
+		t.Fatal(err)
+	}
+
+	lock, err := l.Acquire(context.Background(), time.Minute, key, value, host)
 	if err != nil {
-		t.Error(err)
-		return
+		t.Fatal(err)
+	}
+
+	// renewal stopped, lost without waiting for expiry
+	cancel()
+	select {
+	case err = <-lost:
+		if err != context.Canceled {
+			t.Fatalf("lost err: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("lock lost not reported after keep alive ctx done")
+	}
+	if !lockLost(lock) {
+		t.Fatal("lock not marked lost")
 	}
-	if success {
-		time.Sleep(30 * time.Second)
-		if err = l.UnLock(value); err != nil {
+}
+
+func TestRLock_AcquireContext(t *testing.T) {
+	mr := miniredis.RunT(t)
+	l := newMiniDLock(t, mr)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	time.Sleep(5 * time.Millisecond)
+	if success, err := l.AcquireContext(ctx, time.Minute, key, value, host); err == nil || success {
+		t.Fatalf("acquire with done ctx, success: %t, err: %v", success, err)
+	}
+	if mr.Exists(key) {
+		t.Fatal("lock set with done ctx")
+	}
+
+	success, err := l.AcquireContext(context.Background(), time.Minute, key, value, host)
+	if err != nil || !success {
+		t.Fatalf("acquire fail, success: %t, err: %v", success, err)
+	}
+	if err = l.UnLockContext(context.Background(), key); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRLock_Lock(t *testing.T) {
+	mr := miniredis.RunT(t)
+	l := newMiniDLock(t, mr)
+	other := newMiniDLock(t, mr, WithRetryOption(10*time.Millisecond, 50*time.Millisecond, 0.2))
+
+	if success, err := l.Acquire(time.Minute, key, value, host); err != nil || !success {
+		t.Fatalf("acquire fail, success: %t, err: %v", success, err)
+	}
+
+	// held until ctx done
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := other.Lock(ctx, time.Minute, key, "other", host); err != context.DeadlineExceeded {
+		t.Fatalf("lock held key, err: %v", err)
+	}
+
+	// acquired after released
+	time.AfterFunc(100*time.Millisecond, func() {
+		if err := l.UnLock(key); err != nil {
 			t.Error(err)
-			return
 		}
+	})
+	ctx, cancel = context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := other.Lock(ctx, time.Minute, key, "other", host); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := mr.Get(key); got != "other" {
+		t.Fatalf("lock value: %s, want: other", got)
+	}
+}
+
+func TestRLock_GetToken(t *testing.T) {
+	mr := miniredis.RunT(t)
+	l, other := newMiniDLock(t, mr), newMiniDLock(t, mr)
+
+	if success, err := l.Acquire(time.Minute, key, value, host); err != nil || !success {
+		t.Fatalf("acquire fail, success: %t, err: %v", success, err)
+	}
+	token := l.GetToken(key)
+	if token <= 0 || other.GetToken(key) != 0 {
+		t.Fatalf("token: %d, other token: %d", token, other.GetToken(key))
+	}
+
+	if err := l.UnLock(key); err != nil {
+		t.Fatal(err)
+	}
+	if success, err := other.Acquire(time.Minute, key, "other", host); err != nil || !success {
+		t.Fatalf("acquire fail, success: %t, err: %v", success, err)
+	}
+	if next := other.GetToken(key); next <= token {
+		t.Fatalf("token not increased, %d -> %d", token, next)
+	}
+}
+
+func TestRLock_FencingExpire(t *testing.T) {
+	mr := miniredis.RunT(t)
+	l := newMiniDLock(t, mr)
+
+	if success, err := l.Acquire(time.Minute, key, value, host); err != nil || !success {
+		t.Fatalf("acquire fail, success: %t, err: %v", success, err)
+	}
+	token := l.GetToken(key)
+	if ttl := mr.TTL(fencingKey(key)); ttl != fencingTTL {
+		t.Fatalf("fencing counter ttl: %s, want: %s", ttl, fencingTTL)
+	}
+	if err := l.UnLock(key); err != nil {
+		t.Fatal(err)
+	}
+
+	// counter expired, restarts from server time and still increases
+	mr.FastForward(fencingTTL)
+	if mr.Exists(fencingKey(key)) {
+		t.Fatal("fencing counter not expired")
+	}
+	mr.SetTime(time.Now().Add(fencingTTL))
+	if success, err := l.Acquire(time.Minute, key, value, host); err != nil || !success {
+		t.Fatalf("acquire fail, success: %t, err: %v", success, err)
+	}
+	if next := l.GetToken(key); next <= token {
+		t.Fatalf("token not increased after counter expired, %d -> %d", token, next)
+	}
+}
+
+func TestRLock_Handle(t *testing.T) {
+	mr := miniredis.RunT(t)
+	l := newMiniRLock(t, mr)
+	ctx := context.Background()
+
+	// one locker holds many locks
+	first, err := l.Acquire(ctx, time.Minute, key, value, host)
+	if err != nil || first == nil {
+		t.Fatalf("acquire fail, lock: %v, err: %v", first, err)
+	}
+	second, err := l.Acquire(ctx, time.Minute, key+"_2", value, host)
+	if err != nil || second == nil {
+		t.Fatalf("acquire fail, lock: %v, err: %v", second, err)
+	}
+	if held, err := l.Acquire(ctx, time.Minute, key, "other", host); !errors.Is(err, ErrLockHeld) || held != nil {
+		t.Fatalf("acquire held lock, lock: %v, err: %v", held, err)
+	}
+	if first.Key() != key || first.Value() != value || first.Token() <= 0 {
+		t.Fatalf("lock key: %s, value: %s, token: %d", first.Key(), first.Value(), first.Token())
+	}
+
+	mr.FastForward(30 * time.Second)
+	if err = first.Refresh(ctx, 2*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if ttl, err := first.TTL(ctx); err != nil || ttl <= time.Minute {
+		t.Fatalf("ttl: %s, err: %v", ttl, err)
+	}
+
+	if err = first.Release(ctx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-first.Lost():
+	default:
+		t.Fatal("lost not closed after release")
+	}
+	if err = first.Release(ctx); err != ErrNotOwner {
+		t.Fatalf("release twice, err: %v", err)
+	}
+
+	// second lock is still held, lost after taken over
+	mr.Set(key+"_2", "other")
+	if _, err = second.TTL(ctx); err != ErrNotOwner {
+		t.Fatalf("ttl of lost lock, err: %v", err)
+	}
+	select {
+	case <-second.Lost():
+	default:
+		t.Fatal("lost not closed after taken over")
+	}
+}
+
+func TestRLock_Reentrant(t *testing.T) {
+	mr := miniredis.RunT(t)
+	l := newMiniDLock(t, mr, WithReentrant())
+	other := newMiniDLock(t, mr, WithReentrant())
+
+	for i := 0; i < 2; i++ {
+		if success, err := l.Acquire(time.Minute, key, value, host); err != nil || !success {
+			t.Fatalf("acquire %d fail, success: %t, err: %v", i, success, err)
+		}
+	}
+	if success, err := other.Acquire(time.Minute, key, "other", host); err != nil || success {
+		t.Fatalf("acquire held lock, success: %t, err: %v", success, err)
+	}
+
+	// released after the same times
+	if err := l.UnLock(key); err != nil {
+		t.Fatal(err)
+	}
+	if v := other.GetValue(key); v != value {
+		t.Fatalf("lock value after first unlock: %s, want: %s", v, value)
+	}
+	if err := l.UnLock(key); err != nil {
+		t.Fatal(err)
+	}
+	if locked, err := other.IsLock(key); err != nil || locked {
+		t.Fatalf("lock status: %t, err: %v", locked, err)
+	}
+	if err := l.UnLock(key); err != ErrNotOwner {
+		t.Fatalf("unlock more than acquired, err: %v", err)
+	}
+}
+
+func TestRLock_Instances(t *testing.T) {
+	first, second := miniredis.RunT(t), miniredis.RunT(t)
+
+	// every DLock owns its client, the second server is not ignored
+	l1, err := NewDLock(WithRedisOption("", dialTimeout, first.Addr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l2, err := NewDLock(WithRedisOption("", dialTimeout, second.Addr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range []DLock{l1, l2} {
+		if success, err := l.Acquire(time.Minute, key, value, host); err != nil || !success {
+			t.Fatalf("acquire, success: %t, err: %v", success, err)
+		}
+	}
+	if !first.Exists(key) || !second.Exists(key) {
+		t.Fatal("lock not set on its own server")
+	}
+
+	if err = l1.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = l1.Acquire(time.Minute, key+"_2", value, host); err == nil {
+		t.Fatal("acquire after close")
+	}
+	if success, err := l2.Acquire(time.Minute, key+"_2", value, host); err != nil || !success {
+		t.Fatalf("acquire on other instance after close, success: %t, err: %v", success, err)
+	}
+	if err = l2.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRLock_WithRedisClient(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { _ = client.Close() })
+
+	l, err := NewDLock(WithRedisClient(client))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if success, err := l.Acquire(time.Minute, key, value, host); err != nil || !success {
+		t.Fatalf("acquire, success: %t, err: %v", success, err)
+	}
+
+	// caller-supplied client is left open
+	if err = l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := client.Get(key).Result(); err != nil || v != value {
+		t.Fatalf("client after close, value: %s, err: %v", v, err)
 	}
 }
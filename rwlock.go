@@ -0,0 +1,379 @@
+package dlock
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+)
+
+// RWLock distributed read/write lock
+// many readers or one writer hold a key, a waiting writer blocks new readers
+type RWLock interface {
+	// RLock: block until a shared lock of key is acquired or ctx done
+	// value: lock resource, identify the owner
+	// expiration: must be positive, otherwise return ErrNoExpiration, the same to Lock
+	RLock(ctx context.Context, expiration time.Duration, key, value string) error
+	// RUnlock: release the latest shared lock of key acquired by this RWLock
+	RUnlock(ctx context.Context, key string) error
+	// Lock: block until the exclusive lock of key is acquired or ctx done
+	Lock(ctx context.Context, expiration time.Duration, key, value string) error
+	// Unlock: release the exclusive lock of key acquired by this RWLock
+	Unlock(ctx context.Context, key string) error
+	// Close: release connections of this RWLock, locks held are not released
+	Close() error
+}
+
+// rwLocker backend of RWLock, every holder is identified by a unique id
+type rwLocker interface {
+	// tryRLock return ErrLockHeld if a writer holds or waits for key
+	tryRLock(ctx context.Context, expiration time.Duration, key, value, id string) (Lock, error)
+	// tryLock return ErrLockHeld if held by others, and mark writer id as waiting
+	tryLock(ctx context.Context, expiration, wait time.Duration, key, value, id string) (Lock, error)
+	// cancelWait remove the waiting mark of writer id
+	cancelWait(ctx context.Context, key, id string) error
+	Close() error
+}
+
+// rwLock RWLock adapter, keep the lock handles acquired by key
+type rwLock struct {
+	locker rwLocker
+	opts   Options
+
+	mux *sync.Mutex
+	// lock key -> shared locks held, latest last
+	readers map[string][]Lock
+	// lock key -> exclusive lock held
+	writers map[string]Lock
+}
+
+// NewRWLock create distributed read/write lock, redis and mysql only
+// options: other parameter configs
+func NewRWLock(options ...func(*Options)) (RWLock, error) {
+	var opts Options
+	for i := range options {
+		options[i](&opts)
+	}
+
+	var locker rwLocker
+	var err error
+	switch opts.Type {
+	case MysqlLockType:
+		locker, err = NewMLock(opts)
+	case RedisLockType, "":
+		locker, err = NewRLock(opts)
+	default:
+		return nil, fmt.Errorf("read/write %s lock: %w", opts.Type, NotSupportedTypeLockErr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newRWLock(locker, opts), nil
+}
+
+// newRWLock wrap rwLocker as RWLock
+func newRWLock(locker rwLocker, opts Options) *rwLock {
+	return &rwLock{
+		locker:  locker,
+		opts:    opts,
+		mux:     &sync.Mutex{},
+		readers: map[string][]Lock{},
+		writers: map[string]Lock{},
+	}
+}
+
+// RLock block until a shared lock is acquired or ctx done
+func (l *rwLock) RLock(ctx context.Context, expiration time.Duration, key, value string) error {
+	if expiration <= 0 {
+		return noExpirationErr(key, expiration)
+	}
+	id := holderID()
+	lock, err := waitLock(ctx, l.opts, key, func(ctx context.Context) (Lock, error) {
+		return l.locker.tryRLock(ctx, expiration, key, value, id)
+	})
+	if err != nil {
+		return err
+	}
+
+	l.mux.Lock()
+	l.readers[key] = append(l.readers[key], lock)
+	l.mux.Unlock()
+	return nil
+}
+
+// RUnlock release the latest shared lock
+func (l *rwLock) RUnlock(ctx context.Context, key string) error {
+	l.mux.Lock()
+	readers := l.readers[key]
+	if len(readers) == 0 {
+		l.mux.Unlock()
+		return ErrNotOwner
+	}
+	lock := readers[len(readers)-1]
+	if readers = readers[:len(readers)-1]; len(readers) == 0 {
+		delete(l.readers, key)
+	} else {
+		l.readers[key] = readers
+	}
+	l.mux.Unlock()
+
+	return lock.Release(ctx)
+}
+
+// Lock block until the exclusive lock is acquired or ctx done
+// the writer is marked as waiting while blocked, new readers are rejected
+func (l *rwLock) Lock(ctx context.Context, expiration time.Duration, key, value string) error {
+	if expiration <= 0 {
+		return noExpirationErr(key, expiration)
+	}
+	id := holderID()
+	wait := 2 * newBackoff(l.opts).max
+	lock, err := waitLock(ctx, l.opts, key, func(ctx context.Context) (Lock, error) {
+		return l.locker.tryLock(ctx, expiration, wait, key, value, id)
+	})
+	if err != nil {
+		// ctx is done, remove the waiting mark in background
+		if err := l.locker.cancelWait(context.Background(), key, id); err != nil {
+			l.opts.logger().Log(LevelWarn, "cancel waiting writer fail", "key", key, "err", err)
+		}
+		return err
+	}
+
+	l.mux.Lock()
+	l.writers[key] = lock
+	l.mux.Unlock()
+	return nil
+}
+
+// Unlock release the exclusive lock
+func (l *rwLock) Unlock(ctx context.Context, key string) error {
+	l.mux.Lock()
+	lock, ok := l.writers[key]
+	delete(l.writers, key)
+	l.mux.Unlock()
+	if !ok {
+		return ErrNotOwner
+	}
+	return lock.Release(ctx)
+}
+
+// Close close the backend connections
+func (l *rwLock) Close() error {
+	return l.locker.Close()
+}
+
+// holderID unique id of one acquisition, 16 hex characters
+func holderID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// rwPrelude drop expired entries of hash KEYS[1] and count the holders
+// hash fields: w:<id> writer, r:<id> reader, x:<id> waiting writer; value: expire time ms
+// ARGV[1]: id of caller, excluded from waiting writers
+const rwPrelude = `
+local t = redis.call("time")
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local writers, readers, waiting = 0, 0, 0
+local fields = redis.call("hgetall", KEYS[1])
+for i = 1, #fields, 2 do
+	local f = fields[i]
+	if tonumber(fields[i + 1]) <= now then
+		redis.call("hdel", KEYS[1], f)
+	else
+		local kind = string.sub(f, 1, 2)
+		if kind == "w:" then
+			writers = writers + 1
+		elseif kind == "r:" then
+			readers = readers + 1
+		elseif kind == "x:" and f ~= "x:" .. ARGV[1] then
+			waiting = waiting + 1
+		end
+	end
+end
+local function expire(ttl)
+	if redis.call("pttl", KEYS[1]) < ttl then
+		redis.call("pexpire", KEYS[1], ttl)
+	end
+end
+`
+
+var (
+	// rwRLockScript KEYS[2]: fencing key, ARGV[2]: expiration ms; return fencing token, 0 if writer holds or waits
+	rwRLockScript = redis.NewScript(rwPrelude + fencingPrelude + `
+if writers > 0 or waiting > 0 then
+	return 0
+end
+redis.call("hset", KEYS[1], "r:" .. ARGV[1], now + ARGV[2])
+expire(tonumber(ARGV[2]))
+return nextToken(KEYS[2])
+`)
+
+	// rwLockScript KEYS[2]: fencing key, ARGV[2]: expiration ms, ARGV[3]: waiting ms
+	// return fencing token, 0 if held and mark the caller as waiting
+	rwLockScript = redis.NewScript(rwPrelude + fencingPrelude + `
+if writers > 0 or readers > 0 then
+	redis.call("hset", KEYS[1], "x:" .. ARGV[1], now + ARGV[3])
+	expire(tonumber(ARGV[3]))
+	return 0
+end
+redis.call("hdel", KEYS[1], "x:" .. ARGV[1])
+redis.call("hset", KEYS[1], "w:" .. ARGV[1], now + ARGV[2])
+expire(tonumber(ARGV[2]))
+return nextToken(KEYS[2])
+`)
+
+	// rwReleaseScript ARGV[1]: field; return 0 if not held
+	rwReleaseScript = redis.NewScript(rwPrelude + `
+local n = redis.call("hdel", KEYS[1], ARGV[1])
+if redis.call("hlen", KEYS[1]) == 0 then
+	redis.call("del", KEYS[1])
+end
+return n
+`)
+
+	// rwRenewScript ARGV[1]: field, ARGV[2]: expiration ms; return 0 if not held
+	rwRenewScript = redis.NewScript(rwPrelude + `
+if redis.call("hexists", KEYS[1], ARGV[1]) == 0 then
+	return 0
+end
+redis.call("hset", KEYS[1], ARGV[1], now + ARGV[2])
+expire(tonumber(ARGV[2]))
+return 1
+`)
+
+	// rwTTLScript ARGV[1]: field; return ttl ms, -3 if not held
+	rwTTLScript = redis.NewScript(rwPrelude + `
+local exp = redis.call("hget", KEYS[1], ARGV[1])
+if not exp then
+	return -3
+end
+return tonumber(exp) - now
+`)
+)
+
+// redisRWHolder reader or writer field of read/write lock hash
+type redisRWHolder struct {
+	rc    Clienter
+	key   string
+	field string
+}
+
+// tryRLock add reader field if no writer holds or waits
+func (l *rLock) tryRLock(ctx context.Context, expiration time.Duration, key, value, id string) (Lock, error) {
+	token, err := rwRLockScript.Run(withContext(ctx, l.rc), []string{key, fencingKey(key)}, id, expiration.Milliseconds()).Int64()
+	if err != nil {
+		return nil, backendErr(key, err)
+	}
+	if token <= 0 {
+		return nil, heldErr(key)
+	}
+	return newHandle(key, value, token, expiration, &redisRWHolder{rc: l.rc, key: key, field: "r:" + id}, l.opts), nil
+}
+
+// tryLock add writer field if no one holds, otherwise mark as waiting
+func (l *rLock) tryLock(ctx context.Context, expiration, wait time.Duration, key, value, id string) (Lock, error) {
+	token, err := rwLockScript.Run(withContext(ctx, l.rc), []string{key, fencingKey(key)}, id, expiration.Milliseconds(), wait.Milliseconds()).Int64()
+	if err != nil {
+		return nil, backendErr(key, err)
+	}
+	if token <= 0 {
+		return nil, heldErr(key)
+	}
+	return newHandle(key, value, token, expiration, &redisRWHolder{rc: l.rc, key: key, field: "w:" + id}, l.opts), nil
+}
+
+// cancelWait remove waiting field
+func (l *rLock) cancelWait(ctx context.Context, key, id string) error {
+	return rwReleaseScript.Run(withContext(ctx, l.rc), []string{key}, "x:"+id).Err()
+}
+
+// release delete field
+func (h *redisRWHolder) release(ctx context.Context) error {
+	deleted, err := rwReleaseScript.Run(withContext(ctx, h.rc), []string{h.key}, h.field).Int64()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return ErrNotOwner
+	}
+	return nil
+}
+
+// refresh extend expire time of field
+func (h *redisRWHolder) refresh(ctx context.Context, expiration time.Duration) error {
+	renewed, err := rwRenewScript.Run(withContext(ctx, h.rc), []string{h.key}, h.field, expiration.Milliseconds()).Int64()
+	if err != nil {
+		return err
+	}
+	if renewed == 0 {
+		return ErrNotOwner
+	}
+	return nil
+}
+
+// ttl remaining ttl of field
+func (h *redisRWHolder) ttl(ctx context.Context) (time.Duration, error) {
+	ms, err := rwTTLScript.Run(withContext(ctx, h.rc), []string{h.key}, h.field).Int64()
+	if err != nil {
+		return 0, err
+	}
+	if ms == -3 {
+		return 0, ErrNotOwner
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+// holderKeyLen longest key kept as it is in row names of holders, name is varchar(64)
+const holderKeyLen = 64 - len(":x:") - 16
+
+// holderRowName row name of one holder in dlock table, at most 64 characters for id of holderID
+// kind: w writer, r reader, x waiting writer, s semaphore permit, q fair queue
+// key longer than holderKeyLen is replaced by its sha1
+func holderRowName(key, kind, id string) string {
+	if len(key) > holderKeyLen {
+		sum := sha1.Sum([]byte(key))
+		key = hex.EncodeToString(sum[:])
+	}
+	return key + ":" + kind + ":" + id
+}
+
+// tryRLock insert reader row if no writer holds or waits
+func (l *mLock) tryRLock(ctx context.Context, expiration time.Duration, key, value, id string) (Lock, error) {
+	name := holderRowName(key, "r", id)
+	tab := &LockTable{Name: name, LockResource: value, Expiration: expiration}
+	token, err := l.repo.rLockRes(ctx, key, tab)
+	if err != nil {
+		return nil, backendErr(key, err)
+	}
+	if token <= 0 {
+		return nil, heldErr(key)
+	}
+	return newHandle(key, value, token, expiration, &mysqlHolder{repo: l.repo, token: token, key: name, value: value}, l.opts), nil
+}
+
+// tryLock insert writer row if no one holds, otherwise mark as waiting
+func (l *mLock) tryLock(ctx context.Context, expiration, wait time.Duration, key, value, id string) (Lock, error) {
+	name := holderRowName(key, "w", id)
+	tab := &LockTable{Name: name, LockResource: value, Expiration: expiration}
+	waiting := &LockTable{Name: holderRowName(key, "x", id), LockResource: value, Expiration: wait}
+	token, err := l.repo.wLockRes(ctx, key, tab, waiting)
+	if err != nil {
+		return nil, backendErr(key, err)
+	}
+	if token <= 0 {
+		return nil, heldErr(key)
+	}
+	return newHandle(key, value, token, expiration, &mysqlHolder{repo: l.repo, token: token, key: name, value: value}, l.opts), nil
+}
+
+// cancelWait soft delete waiting row
+func (l *mLock) cancelWait(ctx context.Context, key, id string) error {
+	return l.repo.cancelWaitRes(ctx, holderRowName(key, "x", id))
+}
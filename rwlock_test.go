@@ -0,0 +1,195 @@
+package dlock
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/alicebob/miniredis/v2"
+)
+
+// newMiniRWLock create RWLock on an in-process redis server
+func newMiniRWLock(t *testing.T, mr *miniredis.Miniredis) RWLock {
+	l := newMiniRLock(t, mr, WithRetryOption(10*time.Millisecond, 50*time.Millisecond, 0.2))
+	return newRWLock(l, l.opts)
+}
+
+// timeoutCtx context done after d
+func timeoutCtx(t *testing.T, d time.Duration) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func TestRWLock_Shared(t *testing.T) {
+	mr := miniredis.RunT(t)
+	l, other := newMiniRWLock(t, mr), newMiniRWLock(t, mr)
+
+	// readers share the lock
+	if err := l.RLock(timeoutCtx(t, time.Second), time.Minute, key, value); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.RLock(timeoutCtx(t, time.Second), time.Minute, key, "other"); err != nil {
+		t.Fatal(err)
+	}
+
+	// writer blocked by readers
+	if err := other.Lock(timeoutCtx(t, 100*time.Millisecond), time.Minute, key, "other"); err != context.DeadlineExceeded {
+		t.Fatalf("lock with readers, err: %v", err)
+	}
+
+	if err := l.RUnlock(context.Background(), key); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.RUnlock(context.Background(), key); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Lock(timeoutCtx(t, time.Second), time.Minute, key, "other"); err != nil {
+		t.Fatal(err)
+	}
+
+	// readers blocked by writer
+	if err := l.RLock(timeoutCtx(t, 100*time.Millisecond), time.Minute, key, value); err != context.DeadlineExceeded {
+		t.Fatalf("rlock with writer, err: %v", err)
+	}
+	if err := other.Unlock(context.Background(), key); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Unlock(context.Background(), key); err != ErrNotOwner {
+		t.Fatalf("unlock twice, err: %v", err)
+	}
+	if mr.Exists(key) {
+		t.Fatal("lock hash not deleted")
+	}
+}
+
+func TestRWLock_WriterPreference(t *testing.T) {
+	mr := miniredis.RunT(t)
+	reader, writer := newMiniRWLock(t, mr), newMiniRWLock(t, mr)
+
+	if err := reader.RLock(timeoutCtx(t, time.Second), time.Minute, key, value); err != nil {
+		t.Fatal(err)
+	}
+
+	locked := make(chan error, 1)
+	go func() {
+		locked <- writer.Lock(timeoutCtx(t, 2*time.Second), time.Minute, key, "writer")
+	}()
+
+	// new readers wait behind the waiting writer
+	time.Sleep(50 * time.Millisecond)
+	if err := reader.RLock(timeoutCtx(t, 100*time.Millisecond), time.Minute, key, value); err != context.DeadlineExceeded {
+		t.Fatalf("rlock with waiting writer, err: %v", err)
+	}
+
+	if err := reader.RUnlock(context.Background(), key); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-locked; err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Unlock(context.Background(), key); err != nil {
+		t.Fatal(err)
+	}
+	if err := reader.RLock(timeoutCtx(t, time.Second), time.Minute, key, value); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRWLock_NoExpiration(t *testing.T) {
+	mr := miniredis.RunT(t)
+	l := newMiniRWLock(t, mr)
+
+	// holders without expiration are dropped on the next call, so they are rejected
+	if err := l.RLock(context.Background(), 0, key, value); !errors.Is(err, ErrNoExpiration) {
+		t.Fatalf("rlock without expiration, err: %v", err)
+	}
+	if err := l.Lock(context.Background(), -time.Second, key, value); !errors.Is(err, ErrNoExpiration) {
+		t.Fatalf("lock with negative expiration, err: %v", err)
+	}
+	if mr.Exists(key) {
+		t.Fatal("lock hash written")
+	}
+}
+
+func Test_holderRowName(t *testing.T) {
+	id := holderID()
+	if name := holderRowName(key, "r", id); name != key+":r:"+id {
+		t.Fatalf("row name of short key: %s", name)
+	}
+
+	// long key hashed, the name fits varchar(64)
+	long := strings.Repeat("k", 64)
+	for _, kind := range []string{"w", "r", "x", "s", "q"} {
+		if name := holderRowName(long, kind, id); len(name) > 64 {
+			t.Fatalf("row name of %s is %d characters: %s", kind, len(name), name)
+		}
+	}
+	if holderRowName(long, "r", id) == holderRowName(long+"x", "r", id) {
+		t.Fatal("row names of different keys collide")
+	}
+}
+
+func TestMLock_RWLock(t *testing.T) {
+	r, mock := newMockRepo(t)
+	l := &mLock{repo: r}
+	ctx := context.Background()
+	long := strings.Repeat("k", 64)
+	anyArg := sqlmock.AnyArg()
+
+	// reader rejected by waiting writer
+	expectGuard(mock, long, func() {
+		mock.ExpectQuery(countPrefixSql).WithArgs(prefixArg(long, "w"), anyArg).WillReturnRows(countRows(0))
+		mock.ExpectQuery(countPrefixSql).WithArgs(prefixArg(long, "x"), anyArg).WillReturnRows(countRows(1))
+	})
+	if _, err := l.tryRLock(ctx, time.Minute, long, value, holderID()); !errors.Is(err, ErrLockHeld) {
+		t.Fatalf("rlock with waiting writer, err: %v", err)
+	}
+
+	reader := holderID()
+	expectGuard(mock, long, func() {
+		mock.ExpectQuery(countPrefixSql).WithArgs(prefixArg(long, "w"), anyArg).WillReturnRows(countRows(0))
+		mock.ExpectQuery(countPrefixSql).WithArgs(prefixArg(long, "x"), anyArg).WillReturnRows(countRows(0))
+		mock.ExpectExec(acquireSql).WithArgs(acquireArgs(holderRowName(long, "r", reader), value, "", int64(60), anyArg)...).WillReturnResult(sqlmock.NewResult(5, 1))
+	})
+	lock, err := l.tryRLock(ctx, time.Minute, long, value, reader)
+	if err != nil || lock.Token() != 5 {
+		t.Fatalf("rlock fail, lock: %v, err: %v", lock, err)
+	}
+
+	// writer blocked by reader, waiting row inserted, then extended
+	writer := holderID()
+	waiting := holderRowName(long, "x", writer)
+	expectGuard(mock, long, func() {
+		mock.ExpectQuery(countPrefixSql).WithArgs(prefixArg(long, "w"), anyArg).WillReturnRows(countRows(0))
+		mock.ExpectQuery(countPrefixSql).WithArgs(prefixArg(long, "r"), anyArg).WillReturnRows(countRows(1))
+		mock.ExpectQuery(countNameSql).WithArgs(waiting).WillReturnRows(countRows(0))
+		mock.ExpectExec(acquireSql).WithArgs(acquireArgs(waiting, "writer", "", int64(1), anyArg)...).WillReturnResult(sqlmock.NewResult(6, 1))
+	})
+	if _, err := l.tryLock(ctx, time.Minute, time.Second, long, "writer", writer); !errors.Is(err, ErrLockHeld) {
+		t.Fatalf("lock with reader, err: %v", err)
+	}
+	expectGuard(mock, long, func() {
+		mock.ExpectQuery(countPrefixSql).WithArgs(prefixArg(long, "w"), anyArg).WillReturnRows(countRows(0))
+		mock.ExpectQuery(countPrefixSql).WithArgs(prefixArg(long, "r"), anyArg).WillReturnRows(countRows(1))
+		mock.ExpectQuery(countNameSql).WithArgs(waiting).WillReturnRows(countRows(1))
+		mock.ExpectExec(waitSql).WithArgs(int64(1), anyArg, waiting).WillReturnResult(sqlmock.NewResult(0, 1))
+	})
+	if _, err := l.tryLock(ctx, time.Minute, time.Second, long, "writer", writer); !errors.Is(err, ErrLockHeld) {
+		t.Fatalf("lock with reader again, err: %v", err)
+	}
+
+	// reader gone, waiting row cancelled and writer row inserted
+	expectGuard(mock, long, func() {
+		mock.ExpectQuery(countPrefixSql).WithArgs(prefixArg(long, "w"), anyArg).WillReturnRows(countRows(0))
+		mock.ExpectQuery(countPrefixSql).WithArgs(prefixArg(long, "r"), anyArg).WillReturnRows(countRows(0))
+		mock.ExpectExec(cancelWaitSql).WithArgs(anyArg, waiting).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(acquireSql).WithArgs(acquireArgs(holderRowName(long, "w", writer), "writer", "", int64(60), anyArg)...).WillReturnResult(sqlmock.NewResult(7, 1))
+	})
+	if lock, err = l.tryLock(ctx, time.Minute, time.Second, long, "writer", writer); err != nil || lock.Token() != 7 {
+		t.Fatalf("lock fail, lock: %v, err: %v", lock, err)
+	}
+}
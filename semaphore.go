@@ -0,0 +1,212 @@
+package dlock
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+)
+
+// Semaphore distributed counting semaphore
+// at most permits holders of a key, every permit expires on its own
+type Semaphore interface {
+	// Acquire: block until one of permits of key is acquired or ctx done
+	// ttl: expiration of the permit, release it when the holder crashed, return ErrNoExpiration if ttl <= 0
+	Acquire(ctx context.Context, key string, permits int, ttl time.Duration) (Lock, error)
+	// TryAcquire: try once, return ErrLockHeld if all permits are held
+	TryAcquire(ctx context.Context, key string, permits int, ttl time.Duration) (Lock, error)
+	// Close: release connections of this Semaphore, permits held are not released
+	Close() error
+}
+
+// semLocker backend of Semaphore, every permit holder is identified by a unique id
+type semLocker interface {
+	trySemaphore(ctx context.Context, key string, permits int, ttl time.Duration, id string) (Lock, error)
+	Close() error
+}
+
+// semaphore Semaphore adapter
+type semaphore struct {
+	locker semLocker
+	opts   Options
+}
+
+// NewSemaphore create distributed semaphore, redis and mysql only
+// options: other parameter configs
+func NewSemaphore(options ...func(*Options)) (Semaphore, error) {
+	var opts Options
+	for i := range options {
+		options[i](&opts)
+	}
+
+	var locker semLocker
+	var err error
+	switch opts.Type {
+	case MysqlLockType:
+		locker, err = NewMLock(opts)
+	case RedisLockType, "":
+		locker, err = NewRLock(opts)
+	default:
+		return nil, fmt.Errorf("semaphore %s lock: %w", opts.Type, NotSupportedTypeLockErr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &semaphore{locker: locker, opts: opts}, nil
+}
+
+// Acquire block until a permit is acquired or ctx done
+func (s *semaphore) Acquire(ctx context.Context, key string, permits int, ttl time.Duration) (Lock, error) {
+	if err := checkSemaphore(key, permits, ttl); err != nil {
+		return nil, err
+	}
+	id := holderID()
+	return waitLock(ctx, s.opts, key, func(ctx context.Context) (Lock, error) {
+		return s.locker.trySemaphore(ctx, key, permits, ttl, id)
+	})
+}
+
+// TryAcquire try once to acquire a permit
+func (s *semaphore) TryAcquire(ctx context.Context, key string, permits int, ttl time.Duration) (Lock, error) {
+	if err := checkSemaphore(key, permits, ttl); err != nil {
+		return nil, err
+	}
+	return s.locker.trySemaphore(ctx, key, permits, ttl, holderID())
+}
+
+// checkSemaphore permits and ttl must be positive, a permit without ttl is counted by no backend
+func checkSemaphore(key string, permits int, ttl time.Duration) error {
+	if permits <= 0 {
+		return fmt.Errorf("semaphore %s permits must be positive, got %d", key, permits)
+	}
+	if ttl <= 0 {
+		return noExpirationErr(key, ttl)
+	}
+	return nil
+}
+
+// Close close the backend connections
+func (s *semaphore) Close() error {
+	return s.locker.Close()
+}
+
+// semPrelude current time ms of redis server, drop expired members of sorted set KEYS[1]
+// member: holder id, score: expire time ms
+const semPrelude = `
+local t = redis.call("time")
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+redis.call("zremrangebyscore", KEYS[1], "-inf", now)
+local function expire(ttl)
+	if redis.call("pttl", KEYS[1]) < ttl then
+		redis.call("pexpire", KEYS[1], ttl)
+	end
+end
+`
+
+var (
+	// semAcquireScript KEYS[2]: fencing key, ARGV[1]: id, ARGV[2]: permits, ARGV[3]: ttl ms
+	// return fencing token, 0 if all permits are held
+	semAcquireScript = redis.NewScript(semPrelude + fencingPrelude + `
+if redis.call("zcard", KEYS[1]) >= tonumber(ARGV[2]) then
+	return 0
+end
+redis.call("zadd", KEYS[1], now + ARGV[3], ARGV[1])
+expire(tonumber(ARGV[3]))
+return nextToken(KEYS[2])
+`)
+
+	// semReleaseScript ARGV[1]: id; return 0 if not held
+	semReleaseScript = redis.NewScript(semPrelude + `
+return redis.call("zrem", KEYS[1], ARGV[1])
+`)
+
+	// semRenewScript ARGV[1]: id, ARGV[2]: ttl ms; return 0 if not held
+	semRenewScript = redis.NewScript(semPrelude + `
+if not redis.call("zscore", KEYS[1], ARGV[1]) then
+	return 0
+end
+redis.call("zadd", KEYS[1], "xx", now + ARGV[2], ARGV[1])
+expire(tonumber(ARGV[2]))
+return 1
+`)
+
+	// semTTLScript ARGV[1]: id; return ttl ms, -3 if not held
+	semTTLScript = redis.NewScript(semPrelude + `
+local exp = redis.call("zscore", KEYS[1], ARGV[1])
+if not exp then
+	return -3
+end
+return tonumber(exp) - now
+`)
+)
+
+// redisSemHolder member of semaphore sorted set
+type redisSemHolder struct {
+	rc  Clienter
+	key string
+	id  string
+}
+
+// trySemaphore add member if the sorted set has free permits
+func (l *rLock) trySemaphore(ctx context.Context, key string, permits int, ttl time.Duration, id string) (Lock, error) {
+	token, err := semAcquireScript.Run(withContext(ctx, l.rc), []string{key, fencingKey(key)}, id, permits, ttl.Milliseconds()).Int64()
+	if err != nil {
+		return nil, backendErr(key, err)
+	}
+	if token <= 0 {
+		return nil, heldErr(key)
+	}
+	return newHandle(key, id, token, ttl, &redisSemHolder{rc: l.rc, key: key, id: id}, l.opts), nil
+}
+
+// release remove member
+func (h *redisSemHolder) release(ctx context.Context) error {
+	deleted, err := semReleaseScript.Run(withContext(ctx, h.rc), []string{h.key}, h.id).Int64()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return ErrNotOwner
+	}
+	return nil
+}
+
+// refresh extend expire time of member
+func (h *redisSemHolder) refresh(ctx context.Context, expiration time.Duration) error {
+	renewed, err := semRenewScript.Run(withContext(ctx, h.rc), []string{h.key}, h.id, expiration.Milliseconds()).Int64()
+	if err != nil {
+		return err
+	}
+	if renewed == 0 {
+		return ErrNotOwner
+	}
+	return nil
+}
+
+// ttl remaining ttl of member
+func (h *redisSemHolder) ttl(ctx context.Context) (time.Duration, error) {
+	ms, err := semTTLScript.Run(withContext(ctx, h.rc), []string{h.key}, h.id).Int64()
+	if err != nil {
+		return 0, err
+	}
+	if ms == -3 {
+		return 0, ErrNotOwner
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+// trySemaphore insert permit row if less than permits rows are alive
+// the row is named by holderRowName, lock_resource is the id of holder, both fit the columns for any key
+func (l *mLock) trySemaphore(ctx context.Context, key string, permits int, ttl time.Duration, id string) (Lock, error) {
+	name := holderRowName(key, "s", id)
+	tab := &LockTable{Name: name, LockResource: id, Expiration: ttl}
+	token, err := l.repo.semaphoreRes(ctx, key, int64(permits), tab)
+	if err != nil {
+		return nil, backendErr(key, err)
+	}
+	if token <= 0 {
+		return nil, heldErr(key)
+	}
+	return newHandle(key, id, token, ttl, &mysqlHolder{repo: l.repo, token: token, key: name, value: id}, l.opts), nil
+}
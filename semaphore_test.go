@@ -0,0 +1,141 @@
+package dlock
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/alicebob/miniredis/v2"
+)
+
+// newMiniSemaphore create Semaphore on an in-process redis server
+func newMiniSemaphore(t *testing.T, mr *miniredis.Miniredis) Semaphore {
+	l := newMiniRLock(t, mr, WithRetryOption(10*time.Millisecond, 50*time.Millisecond, 0.2))
+	return &semaphore{locker: l, opts: l.opts}
+}
+
+func TestSemaphore_Permits(t *testing.T) {
+	mr := miniredis.RunT(t)
+	s := newMiniSemaphore(t, mr)
+	ctx := context.Background()
+
+	var held []Lock
+	for i := 0; i < 2; i++ {
+		lock, err := s.TryAcquire(ctx, key, 2, time.Minute)
+		if err != nil || lock == nil {
+			t.Fatalf("permit %d, lock: %v, err: %v", i, lock, err)
+		}
+		held = append(held, lock)
+	}
+	if held[1].Token() <= held[0].Token() {
+		t.Fatalf("token not increased, %d after %d", held[1].Token(), held[0].Token())
+	}
+	if lock, err := s.TryAcquire(ctx, key, 2, time.Minute); !errors.Is(err, ErrLockHeld) || lock != nil {
+		t.Fatalf("all permits held, lock: %v, err: %v", lock, err)
+	}
+	if lock, err := s.Acquire(timeoutCtx(t, 100*time.Millisecond), key, 2, time.Minute); err != context.DeadlineExceeded {
+		t.Fatalf("acquire with all permits held, lock: %v, err: %v", lock, err)
+	}
+
+	if err := held[0].Release(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := held[0].Release(ctx); err != ErrNotOwner {
+		t.Fatalf("release twice, err: %v", err)
+	}
+	lock, err := s.Acquire(timeoutCtx(t, time.Second), key, 2, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl, err := lock.TTL(ctx); err != nil || ttl <= 0 || ttl > time.Minute {
+		t.Fatalf("ttl: %s, err: %v", ttl, err)
+	}
+	if err = lock.Refresh(ctx, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if ttl, _ := lock.TTL(ctx); ttl <= time.Minute {
+		t.Fatalf("ttl not refreshed: %s", ttl)
+	}
+
+	if _, err = s.TryAcquire(ctx, key, 0, time.Minute); err == nil {
+		t.Fatal("zero permits accepted")
+	}
+}
+
+func TestSemaphore_NoExpiration(t *testing.T) {
+	mr := miniredis.RunT(t)
+	s := newMiniSemaphore(t, mr)
+
+	// a permit without ttl is never counted, so it can not be held
+	if lock, err := s.TryAcquire(context.Background(), key, 1, 0); !errors.Is(err, ErrNoExpiration) || lock != nil {
+		t.Fatalf("try acquire without ttl, lock: %v, err: %v", lock, err)
+	}
+	if lock, err := s.Acquire(context.Background(), key, 1, -time.Second); !errors.Is(err, ErrNoExpiration) || lock != nil {
+		t.Fatalf("acquire with negative ttl, lock: %v, err: %v", lock, err)
+	}
+	if len(mr.Keys()) > 0 {
+		t.Fatalf("keys written: %v", mr.Keys())
+	}
+}
+
+func TestSemaphore_Expire(t *testing.T) {
+	mr := miniredis.RunT(t)
+	s := newMiniSemaphore(t, mr)
+	ctx := context.Background()
+
+	crashed, err := s.TryAcquire(ctx, key, 1, 50*time.Millisecond)
+	if err != nil || crashed == nil {
+		t.Fatalf("acquire, lock: %v, err: %v", crashed, err)
+	}
+
+	// expiry is checked against redis server time, the crashed holder frees its permit
+	lock, err := s.Acquire(timeoutCtx(t, time.Second), key, 1, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = crashed.Release(ctx); err != ErrLockExpired || !errors.Is(err, ErrNotOwner) {
+		t.Fatalf("release expired permit, err: %v", err)
+	}
+	if err = lock.Release(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMLock_Semaphore(t *testing.T) {
+	r, mock := newMockRepo(t)
+	l := &mLock{repo: r}
+	ctx := context.Background()
+	long := strings.Repeat("k", 64)
+	anyArg := sqlmock.AnyArg()
+
+	// all permits held
+	expectGuard(mock, long, func() {
+		mock.ExpectQuery(countPrefixSql).WithArgs(prefixArg(long, "s"), anyArg).WillReturnRows(countRows(2))
+	})
+	if _, err := l.trySemaphore(ctx, long, 2, time.Minute, holderID()); !errors.Is(err, ErrLockHeld) {
+		t.Fatalf("acquire held permits, err: %v", err)
+	}
+
+	// permit row named by the key once, lock_resource is the id
+	id := holderID()
+	name := holderRowName(long, "s", id)
+	expectGuard(mock, long, func() {
+		mock.ExpectQuery(countPrefixSql).WithArgs(prefixArg(long, "s"), anyArg).WillReturnRows(countRows(1))
+		mock.ExpectExec(acquireSql).WithArgs(acquireArgs(name, id, "", int64(60), anyArg)...).WillReturnResult(sqlmock.NewResult(3, 1))
+	})
+	lock, err := l.trySemaphore(ctx, long, 2, time.Minute, id)
+	if err != nil || lock.Token() != 3 {
+		t.Fatalf("acquire permit, lock: %v, err: %v", lock, err)
+	}
+	if len(name) > 64 || len(id) > 64 {
+		t.Fatalf("row name %s or lock_resource %s exceeds 64 characters", name, id)
+	}
+
+	mock.ExpectExec(releaseSql).WithArgs(anyArg, name, id, anyArg).WillReturnResult(sqlmock.NewResult(0, 1))
+	if err = lock.Release(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
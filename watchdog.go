@@ -0,0 +1,107 @@
+package dlock
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// keepAliveDivisor renew the lock every expiration/keepAliveDivisor
+const keepAliveDivisor = 3
+
+// watchdog renew a held lock in background until stopped
+type watchdog struct {
+	stop chan struct{}
+	once sync.Once
+}
+
+// startWatchdog start to renew lock of key, see watchdog.start
+func startWatchdog(ctx context.Context, key string, expiration time.Duration, logger Logger, renew func(ctx context.Context) error, onLost func(key string, err error)) *watchdog {
+	w := newWatchdog()
+	w.start(ctx, key, expiration, logger, renew, onLost)
+	return w
+}
+
+// newWatchdog create watchdog not started, so that its owner keep it before renewal start
+func newWatchdog() *watchdog {
+	return &watchdog{stop: make(chan struct{})}
+}
+
+// start renew lock of key in background
+// renew: extend the lock ttl to expiration, return ErrNotOwner if lock is lost
+// onLost: called once when the lock is lost, or with ctx.Err() if ctx done before Stop, may be nil
+// logger: log of renewal failures
+// the watchdog stop on Stop, ctx done or lock lost, nothing to renew if expiration <= 0
+func (w *watchdog) start(ctx context.Context, key string, expiration time.Duration, logger Logger, renew func(ctx context.Context) error, onLost func(key string, err error)) {
+	if expiration <= 0 {
+		return
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	interval := expiration / keepAliveDivisor
+	if interval <= 0 {
+		interval = expiration
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		// lock held until deadline if no renewal succeed
+		deadline := time.Now().Add(expiration)
+		for {
+			var err error
+			select {
+			case <-w.stop:
+				return
+			case <-ctx.Done():
+				// ctx of the owner done along with Stop, not lost
+				if w.stopped() {
+					return
+				}
+				err = ctx.Err()
+			case <-ticker.C:
+				err = renew(ctx)
+			}
+			if err == nil {
+				deadline = time.Now().Add(expiration)
+				continue
+			}
+
+			// backend error: retry on next tick until the lock expire
+			if ctx.Err() == nil && !errors.Is(err, ErrNotOwner) && time.Now().Add(interval).Before(deadline) {
+				logger.Log(LevelWarn, "renew lock fail, retry later", "key", key, "err", err)
+				continue
+			}
+
+			logger.Log(LevelError, "lock lost", "key", key, "err", err)
+			if onLost != nil {
+				onLost(key, err)
+			}
+			return
+		}
+	}()
+}
+
+// stopped whether Stop is called
+func (w *watchdog) stopped() bool {
+	select {
+	case <-w.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// Stop stop renewal, safe to call multiple times
+func (w *watchdog) Stop() {
+	if w == nil {
+		return
+	}
+	w.once.Do(func() {
+		close(w.stop)
+	})
+}
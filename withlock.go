@@ -0,0 +1,57 @@
+package dlock
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// WithLock run fn exclusively while holding the lock of key, acquired by the Locker of dl
+// return ErrLockHeld if the lock is held by others, fn is not called then
+// the lock is renewed every ttl/3 while fn runs, ctx of fn is cancelled if the lock is lost
+// the lock is released when fn returns or panics, the panic is passed on after release
+// a release failure is joined to the error of fn
+func WithLock(ctx context.Context, dl DLock, key string, ttl time.Duration, fn func(ctx context.Context) error) error {
+	lock, err := dl.Locker().Acquire(ctx, ttl, key, holderID(), "")
+	if err != nil {
+		return err
+	}
+	return runLocked(ctx, lock, ttl, fn)
+}
+
+// runLocked run fn with ctx cancelled when lock is lost, release lock on return
+// lock is renewed here unless already kept alive by its Locker
+func runLocked(ctx context.Context, lock Lock, ttl time.Duration, fn func(ctx context.Context) error) (err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var dog *watchdog
+	if !keptAlive(lock) {
+		dog = startWatchdog(ctx, lock.Key(), ttl, lockLogger(lock), func(ctx context.Context) error {
+			return lock.Refresh(ctx, ttl)
+		}, func(key string, err error) {
+			cancel()
+		})
+	}
+	go func() {
+		select {
+		case <-lock.Lost():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	defer func() {
+		dog.Stop()
+		if releaseErr := lock.Release(context.Background()); releaseErr != nil && !errors.Is(releaseErr, ErrNotOwner) {
+			err = errors.Join(err, releaseErr)
+		}
+	}()
+	return fn(ctx)
+}
+
+// keptAlive whether lock is renewed by the watchdog of its Locker
+func keptAlive(lock Lock) bool {
+	h, ok := lock.(*handle)
+	return ok && h.dog != nil
+}
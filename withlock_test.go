@@ -0,0 +1,143 @@
+package dlock
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestWithLock(t *testing.T) {
+	mr := miniredis.RunT(t)
+	l := newDLock(newMiniRLock(t, mr))
+	ctx := context.Background()
+
+	err := WithLock(ctx, l, key, time.Minute, func(ctx context.Context) error {
+		if !mr.Exists(key) {
+			t.Error("lock not held in fn")
+		}
+
+		// held by fn
+		nested := WithLock(ctx, l, key, time.Minute, func(ctx context.Context) error {
+			t.Error("fn called with lock held")
+			return nil
+		})
+		if !errors.Is(nested, ErrLockHeld) {
+			t.Errorf("nested WithLock, err: %v", nested)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mr.Exists(key) {
+		t.Fatal("lock not released")
+	}
+
+	want := errors.New("fn fail")
+	if err = WithLock(ctx, l, key, time.Minute, func(ctx context.Context) error { return want }); err != want {
+		t.Fatalf("fn error, err: %v", err)
+	}
+}
+
+func TestWithLock_Panic(t *testing.T) {
+	mr := miniredis.RunT(t)
+	l := newDLock(newMiniRLock(t, mr))
+
+	func() {
+		defer func() {
+			if r := recover(); r != "boom" {
+				t.Fatalf("recovered: %v", r)
+			}
+		}()
+		_ = WithLock(context.Background(), l, key, time.Minute, func(ctx context.Context) error {
+			panic("boom")
+		})
+	}()
+	if mr.Exists(key) {
+		t.Fatal("lock not released on panic")
+	}
+}
+
+func TestWithLock_Lost(t *testing.T) {
+	mr := miniredis.RunT(t)
+	l := newDLock(newMiniRLock(t, mr))
+
+	err := WithLock(context.Background(), l, key, 300*time.Millisecond, func(ctx context.Context) error {
+		// renewed beyond ttl
+		time.Sleep(400 * time.Millisecond)
+		if ctx.Err() != nil {
+			t.Error("ctx cancelled with lock held")
+		}
+
+		// taken over, renewal fails
+		mr.Set(key, "other")
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+			t.Error("ctx not cancelled after lock lost")
+			return nil
+		}
+	})
+	if err != context.Canceled {
+		t.Fatalf("lost lock, err: %v", err)
+	}
+	if v, _ := mr.Get(key); v != "other" {
+		t.Fatalf("lock of other released, value: %s", v)
+	}
+}
+
+func TestWithLock_ReleaseFail(t *testing.T) {
+	mr := miniredis.RunT(t)
+	l := newDLock(newMiniRLock(t, mr))
+
+	// backend gone before release, both errors returned
+	want := errors.New("fn fail")
+	err := WithLock(context.Background(), l, key, time.Minute, func(ctx context.Context) error {
+		mr.Close()
+		return want
+	})
+	if !errors.Is(err, want) || !errors.Is(err, ErrBackendUnavailable) {
+		t.Fatalf("release fail, err: %v", err)
+	}
+}
+
+// countHolder holder counting renewals, always held
+type countHolder struct {
+	refreshes atomic.Int32
+}
+
+func (h *countHolder) release(ctx context.Context) error {
+	return nil
+}
+
+func (h *countHolder) refresh(ctx context.Context, expiration time.Duration) error {
+	h.refreshes.Add(1)
+	return nil
+}
+
+func (h *countHolder) ttl(ctx context.Context) (time.Duration, error) {
+	return 0, nil
+}
+
+func TestWithLock_KeepAlive(t *testing.T) {
+	h := &countHolder{}
+	ttl := 300 * time.Millisecond
+	lock := newHandle(key, value, 1, ttl, h, Options{KeepAlive: true})
+
+	// renewed by the watchdog of the handle only, every ttl/3
+	err := runLocked(context.Background(), lock, ttl, func(ctx context.Context) error {
+		time.Sleep(350 * time.Millisecond)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := h.refreshes.Load(); n == 0 || n > 4 {
+		t.Fatalf("renewed %d times", n)
+	}
+}